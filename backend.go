@@ -5,20 +5,38 @@ import (
 	"fmt"
 	"strings"
 	"sync"
+	"time"
 
+	lru "github.com/hashicorp/golang-lru"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
 type wireguardBackend struct {
 	*framework.Backend
-	lock sync.Mutex
+
+	// configLock is held for writing by operations that change engine-wide state, such as the config, the address space or group networks, and for reading by operations that check against it.
+	configLock sync.RWMutex
+	groupLocks []*locksutil.LockEntry
+
+	// cache holds decoded groups and rendered configs.  cacheGeneration is incremented by every invalidation.
+	cache           *lru.Cache
+	cacheGeneration uint64
+
+	// pendingGroups holds when each group with pending changes was first changed.
+	pendingGroups   map[string]time.Time
+	pendingLock     sync.Mutex
+	materializeDone chan struct{}
+	materializeStop chan struct{}
 }
 
-func (b *wireguardBackend) put(ctx context.Context, s logical.Storage, path string, data interface{}) error {
-	b.lock.Lock()
-	defer b.lock.Unlock()
+// groupLock returns the lock for a group.  It is held for the whole of an operation that changes a group or its peers, including rebuilding the group.
+func (b *wireguardBackend) groupLock(name string) *locksutil.LockEntry {
+	return locksutil.LockForKey(b.groupLocks, name)
+}
 
+func (b *wireguardBackend) put(ctx context.Context, s logical.Storage, path string, data interface{}) error {
 	entry, err := logical.StorageEntryJSON(path, data)
 	if err != nil {
 		return fmt.Errorf("error creating storage entry: %w", err)
@@ -28,23 +46,71 @@ func (b *wireguardBackend) put(ctx context.Context, s logical.Storage, path stri
 		return fmt.Errorf("error writing to backend: %w", err)
 	}
 
+	b.invalidate(ctx, path)
+
+	return nil
+}
+
+func (b *wireguardBackend) delete(ctx context.Context, s logical.Storage, path string) error {
+	if err := s.Delete(ctx, path); err != nil {
+		return fmt.Errorf("error deleting from backend: %w", err)
+	}
+
+	b.invalidate(ctx, path)
+
 	return nil
 }
 
+func (b *wireguardBackend) periodicFunc(ctx context.Context, req *logical.Request) error {
+	// Rotation and tidy write to storage, which is left to the primary
+	if !b.canMigrate() {
+		return nil
+	}
+
+	now := time.Now()
+
+	if err := b.rotateExpiredKeys(ctx, req.Storage, now); err != nil {
+		return err
+	}
+
+	return b.autoTidy(ctx, req.Storage, now)
+}
+
 func newBackend(ctx context.Context, conf *logical.BackendConfig) (logical.Backend, error) {
-	b := wireguardBackend{}
+	cache, err := lru.New(cacheSize)
+	if err != nil {
+		return nil, err
+	}
+
+	b := wireguardBackend{
+		cache:         cache,
+		groupLocks:    locksutil.CreateLocks(),
+		pendingGroups: map[string]time.Time{},
+	}
 
 	b.Backend = &framework.Backend{
 		BackendType: logical.TypeLogical,
 		Help: strings.TrimSpace(`
 The Wireguard secrets backend manages Wireguard keys and configs.
 `),
-		Paths: paths(&b),
+		Clean:          b.stopMaterializer,
+		InitializeFunc: b.initialize,
+		Invalidate:     b.invalidate,
+		Paths:          paths(&b),
+		PeriodicFunc:   b.periodicFunc,
 		PathsSpecial: &logical.Paths{
-			LocalStorage:    []string{},
-			SealWrapStorage: []string{},
+			LocalStorage: []string{},
+			SealWrapStorage: []string{
+				"creds/",
+				"psk/",
+			},
 		},
-		Secrets: []*framework.Secret{},
+		Secrets:     []*framework.Secret{},
+		WALRollback: b.walRollback,
+	}
+
+	if err := b.Setup(ctx, conf); err != nil {
+		return nil, err
 	}
 
 	return &b, nil
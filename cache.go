@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// cacheSize is the number of decoded groups and rendered configs kept in memory.
+const cacheSize = 1024
+
+// renderedConfig is a wg-quick config, along with the decoded group it was rendered from.  It is only valid while that group is cached.
+type renderedConfig struct {
+	Config string
+	Group  *wireguardGroup
+	MaxTTL int
+	TTL    int
+}
+
+func (r *renderedConfig) response(state string) *logical.Response {
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"config":  r.Config,
+			"max_ttl": r.MaxTTL,
+			"state":   state,
+			"ttl":     r.TTL,
+		},
+	}
+}
+
+// clone returns a copy of the group that can be changed without changing the cached group.
+func (g *wireguardGroup) clone() *wireguardGroup {
+	c := *g
+	c.AccessRules = append([]accessRule(nil), g.AccessRules...)
+	c.DNS = append([]string(nil), g.DNS...)
+	c.Networks = append([]netip.Prefix(nil), g.Networks...)
+	c.Peers = append([]wireguardGroupPeer(nil), g.Peers...)
+	c.PeerRoutes = make(map[string][]netip.Prefix, len(g.PeerRoutes))
+	c.PreviousNetworks = append([]netip.Prefix(nil), g.PreviousNetworks...)
+	c.ReservedRanges = append([]netip.Prefix(nil), g.ReservedRanges...)
+
+	for name, routes := range g.PeerRoutes {
+		c.PeerRoutes[name] = routes
+	}
+
+	return &c
+}
+
+// getCachedGroup returns the group from the cache, decoding it from storage if it isn't cached.  The returned group is shared and must not be changed.
+func (b *wireguardBackend) getCachedGroup(ctx context.Context, s logical.Storage, name string) (*wireguardGroup, error) {
+	if group, ok := b.cache.Get("groups/" + name); ok {
+		return group.(*wireguardGroup), nil
+	}
+
+	generation := atomic.LoadUint64(&b.cacheGeneration)
+
+	group, err := getGroup(ctx, s, name)
+	if err != nil || group == nil {
+		return group, err
+	}
+
+	// Don't cache a group that may have been changed while it was read
+	if atomic.LoadUint64(&b.cacheGeneration) == generation {
+		b.cache.Add("groups/"+name, group)
+	}
+
+	return group, nil
+}
+
+// cacheGroup caches a copy of a group that was just saved, replacing the group that was evicted by the writes.  The group lock must be held.
+func (b *wireguardBackend) cacheGroup(group *wireguardGroup) {
+	b.cache.Add("groups/"+group.Name, group.clone())
+}
+
+// getGroup returns a copy of the group from the cache, decoding it from storage if it isn't cached.
+func (b *wireguardBackend) getGroup(ctx context.Context, s logical.Storage, name string) (*wireguardGroup, error) {
+	group, err := b.getCachedGroup(ctx, s, name)
+	if err != nil || group == nil {
+		return group, err
+	}
+
+	return group.clone(), nil
+}
+
+// invalidate removes anything cached from the storage key.  It is called for every write, and by Vault when a key is changed by another node.
+func (b *wireguardBackend) invalidate(_ context.Context, key string) {
+	atomic.AddUint64(&b.cacheGeneration, 1)
+
+	parts := strings.Split(key, "/")
+
+	switch {
+	case parts[0] == "config":
+		b.cache.Purge()
+	case parts[0] == "groups" && len(parts) == 2:
+		b.cache.Remove(key)
+	case (parts[0] == "creds" || parts[0] == "groups") && len(parts) == 3:
+		b.cache.Remove("wg-quick/" + parts[1] + "/" + parts[2])
+	case parts[0] == "directory" && len(parts) == 3:
+		b.cache.Remove("groups/" + parts[1])
+	case parts[0] == "psk" && len(parts) == 2:
+		b.cache.Remove("groups/" + parts[1])
+	}
+}
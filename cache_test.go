@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache(t *testing.T) {
+	b, s := getTestBackend(t)
+	res, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/mygroup",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"network": "10.0.0.0/24",
+		},
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	for _, name := range []string{"peer1", "peer2"} {
+		res, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      "groups/mygroup/" + name,
+			Storage:   s,
+			Data: map[string]interface{}{
+				"port": 51820,
+			},
+		})
+		require.Nil(t, err)
+		require.Nil(t, res)
+	}
+
+	read := func() string {
+		res, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "groups/mygroup/peer1/wg-quick",
+			Storage:   s,
+		})
+		require.Nil(t, err)
+
+		return res.Data["config"].(string)
+	}
+
+	// Changes made by another node are served from the cache until they are invalidated
+	config := read()
+	require.Contains(t, config, "Endpoint=peer2:51820")
+
+	entry, err := s.Get(context.Background(), directoryPath("mygroup", directoryBucket("peer2")))
+	require.Nil(t, err)
+	require.Nil(t, s.Put(context.Background(), &logical.StorageEntry{
+		Key:   entry.Key,
+		Value: []byte(strings.ReplaceAll(string(entry.Value), `"hostname":"peer2"`, `"hostname":"peer2.example.com"`)),
+	}))
+	require.Equal(t, config, read())
+
+	b.Invalidate(context.Background(), entry.Key)
+	require.Contains(t, read(), "Endpoint=peer2.example.com:51820")
+
+	entry, err = logical.StorageEntryJSON("creds/mygroup/peer1", &wireguardPeerCreds{
+		PrivateKey: privateKey,
+	})
+	require.Nil(t, err)
+	require.Nil(t, s.Put(context.Background(), entry))
+	require.NotContains(t, read(), privateKey)
+
+	b.Invalidate(context.Background(), "creds/mygroup/peer1")
+	require.Contains(t, read(), "PrivateKey="+privateKey)
+
+	// Writes invalidate the cache
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "groups/mygroup/peer2",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"port": 51821,
+		},
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+	require.Contains(t, read(), "Endpoint=peer2:51821")
+
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"mtu": 1280,
+		},
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+	require.Contains(t, read(), "MTU=1280")
+
+	// Groups can be changed without changing the cache
+	group, err := b.getGroup(context.Background(), s, "mygroup")
+	require.Nil(t, err)
+
+	group.Peers[0].Name = "changed"
+	group.Networks[0] = group.Networks[0].Masked()
+
+	cached, err := b.getCachedGroup(context.Background(), s, "mygroup")
+	require.Nil(t, err)
+	require.Equal(t, "peer1", cached.Peers[0].Name)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// directoryBuckets is how many entries a group directory is split into.  A peer write only rewrites the bucket of that peer, so writes stay small and entries stay under the storage entry size limit in groups with many peers.
+const directoryBuckets = 256
+
+// wireguardDirectoryBucket is the directory entries of the peers whose names hash to the same bucket.
+type wireguardDirectoryBucket struct {
+	Peers []wireguardGroupPeer `json:"peers"`
+}
+
+// directoryBucket returns the bucket the directory entry of a peer is stored in.
+func directoryBucket(name string) string {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+
+	return fmt.Sprintf("%02x", h.Sum32()%directoryBuckets)
+}
+
+func directoryPath(groupName, bucket string) string {
+	return "directory/" + groupName + "/" + bucket
+}
+
+// getDirectory returns the directory entries of a group, sorted by name.
+func getDirectory(ctx context.Context, s logical.Storage, groupName string) ([]wireguardGroupPeer, error) {
+	buckets, err := s.List(ctx, "directory/"+groupName+"/")
+	if err != nil {
+		return nil, fmt.Errorf("error listing group directory: %w", err)
+	}
+
+	peers := []wireguardGroupPeer{}
+
+	for _, bucket := range buckets {
+		entry, err := s.Get(ctx, directoryPath(groupName, bucket))
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving group directory: %w", err)
+		}
+
+		if entry == nil {
+			continue
+		}
+
+		var b wireguardDirectoryBucket
+
+		if err := entry.DecodeJSON(&b); err != nil {
+			return nil, fmt.Errorf("error decoding group directory: %w", err)
+		}
+
+		peers = append(peers, b.Peers...)
+	}
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Name < peers[j].Name
+	})
+
+	return peers, nil
+}
+
+// putGroup saves the group and its directory.  If names are given, only the directory buckets of those peers are written, along with the group entry if their routes changed.  Otherwise the group entry and every bucket are written.  Buckets without peers are deleted.  The saved group replaces the cached one, so the next write doesn't read the directory again.
+func (b *wireguardBackend) putGroup(ctx context.Context, s logical.Storage, group *wireguardGroup, names ...string) error {
+	// Groups that still embed their directory are moved to buckets on the first write
+	if len(names) == 0 || group.embeddedDirectory || group.PeerRoutes == nil {
+		return b.putGroupDirectory(ctx, s, group)
+	}
+
+	changed := map[string]bool{}
+	for _, name := range names {
+		changed[directoryBucket(name)] = true
+	}
+
+	if err := b.putDirectoryBuckets(ctx, s, group, changed); err != nil {
+		return err
+	}
+
+	if group.updatePeerRoutes(names...) {
+		if err := b.putGroupEntry(ctx, s, group); err != nil {
+			return err
+		}
+	}
+
+	b.cacheGroup(group)
+
+	return nil
+}
+
+// putGroupDirectory saves the group entry and every bucket of its directory.
+func (b *wireguardBackend) putGroupDirectory(ctx context.Context, s logical.Storage, group *wireguardGroup) error {
+	existing, err := s.List(ctx, "directory/"+group.Name+"/")
+	if err != nil {
+		return fmt.Errorf("error listing group directory: %w", err)
+	}
+
+	changed := map[string]bool{}
+	for _, bucket := range existing {
+		changed[bucket] = true
+	}
+
+	for _, peer := range group.Peers {
+		changed[directoryBucket(peer.Name)] = true
+	}
+
+	if err := b.putDirectoryBuckets(ctx, s, group, changed); err != nil {
+		return err
+	}
+
+	group.indexPeerRoutes()
+
+	if err := b.putGroupEntry(ctx, s, group); err != nil {
+		return err
+	}
+
+	group.embeddedDirectory = false
+	b.cacheGroup(group)
+
+	return nil
+}
+
+// putGroupEntry saves the group without its directory.
+func (b *wireguardBackend) putGroupEntry(ctx context.Context, s logical.Storage, group *wireguardGroup) error {
+	entry := *group
+	entry.Peers = nil
+
+	return b.put(ctx, s, "groups/"+group.Name, &entry)
+}
+
+// putDirectoryBuckets writes the changed buckets of the group directory, deleting the ones without peers.
+func (b *wireguardBackend) putDirectoryBuckets(ctx context.Context, s logical.Storage, group *wireguardGroup, changed map[string]bool) error {
+	buckets := map[string]*wireguardDirectoryBucket{}
+
+	for bucket := range changed {
+		buckets[bucket] = &wireguardDirectoryBucket{
+			Peers: []wireguardGroupPeer{},
+		}
+	}
+
+	for _, peer := range group.Peers {
+		if bucket, ok := buckets[directoryBucket(peer.Name)]; ok {
+			bucket.Peers = append(bucket.Peers, peer)
+		}
+	}
+
+	names := make([]string, 0, len(buckets))
+	for name := range buckets {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		if len(buckets[name].Peers) == 0 {
+			if err := b.delete(ctx, s, directoryPath(group.Name, name)); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err := b.put(ctx, s, directoryPath(group.Name, name), buckets[name]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteDirectory deletes every bucket of a group directory.
+func (b *wireguardBackend) deleteDirectory(ctx context.Context, s logical.Storage, groupName string) error {
+	buckets, err := s.List(ctx, "directory/"+groupName+"/")
+	if err != nil {
+		return fmt.Errorf("error listing group directory: %w", err)
+	}
+
+	for _, bucket := range buckets {
+		if err := b.delete(ctx, s, directoryPath(groupName, bucket)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// wireguardEndpoint is an address a peer can be reached on.  Endpoints with a site are only used by peers in the same site, and endpoints without one are public.
+type wireguardEndpoint struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	Site string `json:"site"`
+}
+
+// parseEndpoint parses an endpoint in the form "[site=]host:port".  IPv6 addresses must be in brackets, like [fd00::1]:51820.
+func parseEndpoint(value string) (wireguardEndpoint, error) {
+	endpoint := wireguardEndpoint{}
+
+	if i := strings.Index(value, "="); i >= 0 {
+		endpoint.Site = strings.ToLower(value[:i])
+		value = value[i+1:]
+
+		if endpoint.Site == "" {
+			return endpoint, fmt.Errorf("missing site in endpoint %s", value)
+		}
+	}
+
+	host, port, err := net.SplitHostPort(value)
+	if err != nil {
+		return endpoint, err
+	}
+
+	if host == "" {
+		return endpoint, fmt.Errorf("missing host in endpoint %s", value)
+	}
+
+	endpoint.Host = host
+	endpoint.Port, err = strconv.Atoi(port)
+
+	if err != nil || endpoint.Port < 1 || endpoint.Port > 65535 {
+		return endpoint, fmt.Errorf("invalid port in endpoint %s", value)
+	}
+
+	return endpoint, nil
+}
+
+// address returns the endpoint as used by wireguard, with IPv6 addresses in brackets.
+func (e wireguardEndpoint) address() string {
+	return net.JoinHostPort(e.Host, strconv.Itoa(e.Port))
+}
+
+func (e wireguardEndpoint) String() string {
+	if e.Site != "" {
+		return e.Site + "=" + e.address()
+	}
+
+	return e.address()
+}
+
+// endpoint returns the best endpoint of the peer for a peer in site.  Endpoints in the same site are used first, then public endpoints, and then the hostname and port of the peer.  Returns an empty string if the peer can't be reached.
+func (p wireguardGroupPeer) endpoint(site string) string {
+	for _, endpoint := range p.Endpoints {
+		if site != "" && endpoint.Site == site {
+			return endpoint.address()
+		}
+	}
+
+	for _, endpoint := range p.Endpoints {
+		if endpoint.Site == "" {
+			return endpoint.address()
+		}
+	}
+
+	if p.Port != 0 {
+		return wireguardEndpoint{
+			Host: strings.Trim(p.Hostname, "[]"),
+			Port: p.Port,
+		}.address()
+	}
+
+	return ""
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+const (
+	ipamModeKey        = "key"
+	ipamModeSequential = "sequential"
+)
+
+// ipamKeyAttempts is how many addresses are derived from a key before falling back to sequential allocation.
+const ipamKeyAttempts = 8
+
+var errNetworkFull = errors.New("no free addresses left in group network")
+
+type ipSet map[netip.Addr]struct{}
+
+func (s ipSet) add(ip netip.Addr) {
+	s[ip] = struct{}{}
+}
+
+func (s ipSet) has(ip netip.Addr) bool {
+	_, ok := s[ip]
+
+	return ok
+}
+
+type prefixSet map[netip.Prefix]struct{}
+
+func (s prefixSet) add(prefix netip.Prefix) {
+	s[prefix] = struct{}{}
+}
+
+func (s prefixSet) has(prefix netip.Prefix) bool {
+	_, ok := s[prefix]
+
+	return ok
+}
+
+// lastAddr returns the highest address within the prefix.
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Masked().Addr().AsSlice()
+
+	for i := prefix.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 1 << (7 - i%8)
+	}
+
+	addr, _ := netip.AddrFromSlice(b)
+
+	return addr
+}
+
+// isHostAddr reports whether ip can be handed to a peer in network.  The network address and the IPv4 broadcast address are never used.
+func isHostAddr(network netip.Prefix, ip netip.Addr) bool {
+	if !network.Contains(ip) || ip == network.Masked().Addr() {
+		return false
+	}
+
+	if ip.Is4() && network.Bits() < 31 && ip == lastAddr(network) {
+		return false
+	}
+
+	return true
+}
+
+// deriveIP returns the address in network derived from key.  The host bits are taken from SHA-256(key) for the first attempt, and SHA-256(key + attempt byte) after that.
+func deriveIP(network netip.Prefix, key string, attempt int) netip.Addr {
+	input := []byte(key)
+	if attempt > 0 {
+		input = append(input, byte(attempt))
+	}
+
+	hash := sha256.Sum256(input)
+	b := network.Masked().Addr().AsSlice()
+
+	for i := network.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= hash[i/8] & (1 << (7 - i%8))
+	}
+
+	addr, _ := netip.AddrFromSlice(b)
+
+	return addr
+}
+
+// parsePrefixes parses a list of prefixes, returning them in their masked form.
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := []netip.Prefix{}
+
+	for _, value := range values {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, err
+		}
+
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+func prefixesContain(prefixes []netip.Prefix, ip netip.Addr) bool {
+	return containingPrefix(prefixes, ip).IsValid()
+}
+
+// containingPrefix returns the first of prefixes that contains ip, or an invalid prefix if none do.
+func containingPrefix(prefixes []netip.Prefix, ip netip.Addr) netip.Prefix {
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return prefix
+		}
+	}
+
+	return netip.Prefix{}
+}
+
+// prefixWithin reports whether prefix is inside one of networks.
+func prefixWithin(prefix netip.Prefix, networks []netip.Prefix) bool {
+	network := containingPrefix(networks, prefix.Addr())
+
+	return network.IsValid() && network.Bits() <= prefix.Bits()
+}
+
+// allocateIP returns the lowest host address in network that is not in used or a reserved range.  Reserved ranges are skipped as a whole, so large IPv6 ranges don't have to be walked one address at a time.
+func allocateIP(network netip.Prefix, used ipSet, reserved []netip.Prefix) (netip.Addr, error) {
+	if !network.IsValid() {
+		return netip.Addr{}, errors.New("group network is not valid")
+	}
+
+	last := lastAddr(network)
+
+	for ip := network.Masked().Addr(); ip.IsValid(); {
+		end := ip
+
+		if prefix := containingPrefix(reserved, ip); prefix.IsValid() {
+			end = lastAddr(prefix)
+		} else if isHostAddr(network, ip) && !used.has(ip) {
+			return ip, nil
+		}
+
+		if end.Compare(last) >= 0 {
+			break
+		}
+
+		ip = end.Next()
+	}
+
+	return netip.Addr{}, errNetworkFull
+}
+
+// isDelegatedPrefix reports whether prefix is an aligned prefix of length bits within network.
+func isDelegatedPrefix(network netip.Prefix, bits int, prefix netip.Prefix) bool {
+	return network.IsValid() && prefix.IsValid() && prefix.Bits() == bits && prefix == prefix.Masked() && network.Contains(prefix.Addr())
+}
+
+// allocatePrefix returns the lowest prefix of length bits within network that is not in used.  The allocated prefix is added to used.
+func allocatePrefix(network netip.Prefix, bits int, used prefixSet) (netip.Prefix, error) {
+	if !network.IsValid() || bits < network.Bits() || bits > network.Addr().BitLen() {
+		return netip.Prefix{}, fmt.Errorf("can't delegate /%d prefixes from %s", bits, network)
+	}
+
+	last := lastAddr(network)
+
+	for ip := network.Masked().Addr(); ip.IsValid(); {
+		prefix := netip.PrefixFrom(ip, bits)
+		if !used.has(prefix) {
+			used.add(prefix)
+
+			return prefix, nil
+		}
+
+		end := lastAddr(prefix)
+		if end == last {
+			break
+		}
+
+		ip = end.Next()
+	}
+
+	return netip.Prefix{}, errors.New("no free prefixes left in delegation network")
+}
+
+// ownedPrefix is a prefix used by a group or peer, with a description of the owner for error messages.
+type ownedPrefix struct {
+	Owner  string
+	Peer   string
+	Prefix netip.Prefix
+}
+
+// findOverlap returns the first owned prefix that overlaps prefix.
+func findOverlap(prefix netip.Prefix, owned []ownedPrefix) *ownedPrefix {
+	for i := range owned {
+		if owned[i].Prefix.Overlaps(prefix) {
+			return &owned[i]
+		}
+	}
+
+	return nil
+}
+
+// allocateFreePrefix returns the lowest prefix of length bits within supernet that doesn't overlap a taken prefix.
+func allocateFreePrefix(supernet netip.Prefix, bits int, taken []ownedPrefix) (netip.Prefix, error) {
+	if bits < supernet.Bits() || bits > supernet.Addr().BitLen() {
+		return netip.Prefix{}, fmt.Errorf("can't allocate a /%d from %s", bits, supernet)
+	}
+
+	last := lastAddr(supernet)
+
+	for ip := supernet.Masked().Addr(); ip.IsValid(); {
+		prefix := netip.PrefixFrom(ip, bits)
+		end := lastAddr(prefix)
+
+		overlap := findOverlap(prefix, taken)
+		if overlap == nil {
+			return prefix, nil
+		}
+
+		// Skip past whichever of the two prefixes is bigger
+		if overlap.Prefix.Bits() < bits {
+			end = lastAddr(overlap.Prefix)
+		}
+
+		if end.Compare(last) >= 0 {
+			break
+		}
+
+		ip = end.Next()
+	}
+
+	return netip.Prefix{}, fmt.Errorf("no free /%d left in %s", bits, supernet)
+}
+
+// generateULA returns a random IPv6 unique local /48, as described in RFC 4193.
+func generateULA() (netip.Prefix, error) {
+	b := [16]byte{0xfd}
+
+	if _, err := rand.Read(b[1:6]); err != nil {
+		return netip.Prefix{}, err
+	}
+
+	return netip.PrefixFrom(netip.AddrFrom16(b), 48), nil
+}
+
+// parseNetworks parses the group networks, allowing at most one network per address family.
+func parseNetworks(values []string) ([]netip.Prefix, error) {
+	networks := []netip.Prefix{}
+
+	for _, value := range values {
+		network, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, existing := range networks {
+			if existing.Addr().Is4() == network.Addr().Is4() {
+				return nil, fmt.Errorf("only one network per address family is allowed: %s and %s", existing, network)
+			}
+		}
+
+		networks = append(networks, network)
+	}
+
+	if len(networks) == 0 {
+		return nil, errors.New("at least one network is required")
+	}
+
+	return networks, nil
+}
+
+// addrIn returns the first address of ips that can be used by a peer in network.
+func addrIn(network netip.Prefix, ips []netip.Addr) netip.Addr {
+	for _, ip := range ips {
+		if isHostAddr(network, ip) {
+			return ip
+		}
+	}
+
+	return netip.Addr{}
+}
+
+// allocateIPs returns one address for each network, keeping the addresses from current that are within the network and allocating the rest.  If key is set, addresses are derived from it first.  Allocated addresses are added to used.
+func allocateIPs(networks []netip.Prefix, current []netip.Addr, used ipSet, reserved []netip.Prefix, key string) ([]netip.Addr, error) {
+	ips := make([]netip.Addr, len(networks))
+
+	for i, network := range networks {
+		ips[i] = addrIn(network, current)
+
+		for attempt := 0; key != "" && !ips[i].IsValid() && attempt < ipamKeyAttempts; attempt++ {
+			if ip := deriveIP(network, key, attempt); isHostAddr(network, ip) && !used.has(ip) && !prefixesContain(reserved, ip) {
+				ips[i] = ip
+				used.add(ip)
+			}
+		}
+
+		if !ips[i].IsValid() {
+			ip, err := allocateIP(network, used, reserved)
+			if err != nil {
+				return nil, err
+			}
+
+			ips[i] = ip
+			used.add(ip)
+		}
+	}
+
+	return ips, nil
+}
+
+// renumberIP moves ip from the from network to the to network, keeping its offset within the network.  Returns an invalid address if the offset doesn't fit in the to network.
+func renumberIP(ip netip.Addr, from, to netip.Prefix) netip.Addr {
+	if !from.Contains(ip) || ip.BitLen() != to.Addr().BitLen() {
+		return netip.Addr{}
+	}
+
+	host := ip.AsSlice()
+	b := to.Masked().Addr().AsSlice()
+
+	for i := range host {
+		for j := 0; j < 8; j++ {
+			bit := i*8 + j
+			if bit < from.Bits() || host[i]&(1<<(7-j)) == 0 {
+				continue
+			}
+
+			if bit < to.Bits() {
+				return netip.Addr{}
+			}
+
+			b[i] |= 1 << (7 - j)
+		}
+	}
+
+	addr, _ := netip.AddrFromSlice(b)
+
+	return addr
+}
+
+// hostPrefix returns the single address prefix for ip.
+func hostPrefix(ip netip.Addr) netip.Prefix {
+	return netip.PrefixFrom(ip, ip.BitLen())
+}
+
+func joinAddrs(ips []netip.Addr) string {
+	values := make([]string, len(ips))
+	for i := range ips {
+		values[i] = ips[i].String()
+	}
+
+	return strings.Join(values, ",")
+}
+
+func joinPrefixes(prefixes []netip.Prefix) string {
+	values := make([]string, len(prefixes))
+	for i := range prefixes {
+		values[i] = prefixes[i].String()
+	}
+
+	return strings.Join(values, ",")
+}
+
+func equalAddrs(a, b []netip.Addr) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// materializeTick is how often the materialize worker checks for groups with pending changes.
+const materializeTick = time.Second
+
+const (
+	statePending = "pending"
+	stateSettled = "settled"
+)
+
+type wireguardPendingPeer struct {
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// applyGroupPeer replaces the directory entry of a peer, or removes it if peer is nil.  Returns whether a peer was added or removed.
+func applyGroupPeer(group *wireguardGroup, name string, peer *wireguardPeer) bool {
+	i := sort.Search(len(group.Peers), func(i int) bool {
+		return group.Peers[i].Name >= name
+	})
+	exists := i < len(group.Peers) && group.Peers[i].Name == name
+
+	switch {
+	case peer == nil && exists:
+		group.Peers = append(group.Peers[:i], group.Peers[i+1:]...)
+	case peer == nil:
+	case exists:
+		group.Peers[i] = groupPeer(group, peer)
+	default:
+		group.Peers = append(group.Peers[:i], append([]wireguardGroupPeer{groupPeer(group, peer)}, group.Peers[i:]...)...)
+	}
+
+	return exists == (peer == nil)
+}
+
+// directoryPeer returns the directory entry of a peer, if the group has one.
+func directoryPeer(group *wireguardGroup, name string) (wireguardGroupPeer, bool) {
+	i := sort.Search(len(group.Peers), func(i int) bool {
+		return group.Peers[i].Name >= name
+	})
+
+	if i < len(group.Peers) && group.Peers[i].Name == name {
+		return group.Peers[i], true
+	}
+
+	return wireguardGroupPeer{}, false
+}
+
+// getPendingPeers returns the peers with changes that haven't been applied to the group directory yet, keyed by name.  Deleted peers are nil.
+func getPendingPeers(ctx context.Context, s logical.Storage, groupName string) (map[string]*wireguardPeer, error) {
+	names, err := s.List(ctx, "pending/"+groupName+"/")
+	if err != nil {
+		return nil, fmt.Errorf("error listing pending peers: %w", err)
+	}
+
+	pending := map[string]*wireguardPeer{}
+
+	for _, name := range names {
+		peer, err := getPeer(ctx, s, groupName, name)
+		if err != nil {
+			return nil, err
+		}
+
+		pending[name] = peer
+	}
+
+	return pending, nil
+}
+
+// applyPendingPeers applies the pending changes to the group directory, so it can be used to check the addresses in use.  Returns whether a peer was added or removed.
+func applyPendingPeers(ctx context.Context, s logical.Storage, group *wireguardGroup) (bool, error) {
+	pending, err := getPendingPeers(ctx, s, group.Name)
+	if err != nil {
+		return false, err
+	}
+
+	changed := false
+
+	for name, peer := range pending {
+		if applyGroupPeer(group, name, peer) {
+			changed = true
+		}
+	}
+
+	return changed, nil
+}
+
+// groupState returns whether the group directory has pending changes.
+func groupState(ctx context.Context, s logical.Storage, groupName string) (string, error) {
+	names, err := s.List(ctx, "pending/"+groupName+"/")
+	if err != nil {
+		return "", fmt.Errorf("error listing pending peers: %w", err)
+	}
+
+	if len(names) > 0 {
+		return statePending, nil
+	}
+
+	return stateSettled, nil
+}
+
+// clearPending removes the pending changes of a group, once they have been applied.
+func (b *wireguardBackend) clearPending(ctx context.Context, s logical.Storage, groupName string) error {
+	names, err := s.List(ctx, "pending/"+groupName+"/")
+	if err != nil {
+		return fmt.Errorf("error listing pending peers: %w", err)
+	}
+
+	for _, name := range names {
+		if err := s.Delete(ctx, "pending/"+groupName+"/"+name); err != nil {
+			return fmt.Errorf("error deleting pending peer: %w", err)
+		}
+	}
+
+	b.pendingLock.Lock()
+	delete(b.pendingGroups, groupName)
+	b.pendingLock.Unlock()
+
+	return nil
+}
+
+// markPending records a change to a peer that will be applied to the group directory by the materialize worker.
+func (b *wireguardBackend) markPending(ctx context.Context, s logical.Storage, groupName, name string) error {
+	now := time.Now()
+
+	if err := b.put(ctx, s, "pending/"+groupName+"/"+name, wireguardPendingPeer{
+		ChangedAt: now,
+	}); err != nil {
+		return err
+	}
+
+	b.pendingLock.Lock()
+	defer b.pendingLock.Unlock()
+
+	if _, ok := b.pendingGroups[groupName]; !ok {
+		b.pendingGroups[groupName] = now
+	}
+
+	return nil
+}
+
+// materializeGroup applies the pending changes of a group to its directory.
+func (b *wireguardBackend) materializeGroup(ctx context.Context, s logical.Storage, groupName string) error {
+	lock := b.groupLock(groupName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	group, err := b.getGroup(ctx, s, groupName)
+	if err != nil {
+		return err
+	}
+
+	if group == nil {
+		return b.clearPending(ctx, s, groupName)
+	}
+
+	config, err := getConfig(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	changed, err := applyPendingPeers(ctx, s, group)
+	if err != nil {
+		return err
+	}
+
+	presharedKeys := resolveSettings(config.settingsLayer(), group.settingsLayer()).string("preshared_keys")
+	if changed && presharedKeys == presharedKeysPair {
+		res, err := b.updateGroupPeers(ctx, s, group, nil)
+		if err == nil && res != nil && res.IsError() {
+			err = res.Error()
+		}
+
+		return err
+	}
+
+	if err := b.updateGroupPSK(ctx, s, groupName, presharedKeys, false); err != nil {
+		return err
+	}
+
+	names, err := s.List(ctx, "pending/"+groupName+"/")
+	if err != nil {
+		return fmt.Errorf("error listing pending peers: %w", err)
+	}
+
+	if err := b.putGroup(ctx, s, group, names...); err != nil {
+		return err
+	}
+
+	return b.clearPending(ctx, s, groupName)
+}
+
+// materializeDue materializes the groups whose first pending change is older than their materialize interval.
+func (b *wireguardBackend) materializeDue(ctx context.Context, s logical.Storage, now time.Time) {
+	b.pendingLock.Lock()
+
+	pending := make(map[string]time.Time, len(b.pendingGroups))
+	for name, since := range b.pendingGroups {
+		pending[name] = since
+	}
+
+	b.pendingLock.Unlock()
+
+	for name, since := range pending {
+		config, err := getConfig(ctx, s)
+		if err != nil {
+			b.Logger().Error("error materializing group", "group", name, "error", err)
+
+			continue
+		}
+
+		group, err := b.getGroup(ctx, s, name)
+		if err != nil {
+			b.Logger().Error("error materializing group", "group", name, "error", err)
+
+			continue
+		}
+
+		if group != nil && now.Sub(since) < time.Duration(resolveSettings(config.settingsLayer(), group.settingsLayer()).int("materialize_interval"))*time.Second {
+			continue
+		}
+
+		if err := b.materializeGroup(ctx, s, name); err != nil {
+			b.Logger().Error("error materializing group", "group", name, "error", err)
+		}
+	}
+}
+
+// startMaterializer starts the worker that applies pending changes to group directories, stopping a worker started by an earlier initialize.  Groups left with pending changes, such as by a restart, are materialized on the first tick.
+func (b *wireguardBackend) startMaterializer(ctx context.Context, s logical.Storage) error {
+	b.stopMaterializer(ctx)
+
+	groups, err := s.List(ctx, "pending/")
+	if err != nil {
+		return fmt.Errorf("error listing pending groups: %w", err)
+	}
+
+	b.pendingLock.Lock()
+
+	for _, group := range groups {
+		b.pendingGroups[group[:len(group)-1]] = time.Time{}
+	}
+
+	b.pendingLock.Unlock()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	b.materializeStop = stop
+	b.materializeDone = done
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(materializeTick)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				b.materializeDue(context.Background(), s, now)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// stopMaterializer stops the materialize worker, waiting for a running materialization to finish.
+func (b *wireguardBackend) stopMaterializer(_ context.Context) {
+	if b.materializeStop == nil {
+		return
+	}
+
+	close(b.materializeStop)
+	<-b.materializeDone
+
+	b.materializeDone = nil
+	b.materializeStop = nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaterialize(t *testing.T) {
+	b, s := getTestBackend(t)
+	res, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/mygroup",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"materialize_interval": "1m",
+			"network":              "10.0.0.0/24",
+		},
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	for _, name := range []string{"peer1", "peer2"} {
+		res, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      "groups/mygroup/" + name,
+			Storage:   s,
+		})
+		require.Nil(t, err)
+		require.Nil(t, res)
+	}
+
+	read := func(path string) map[string]interface{} {
+		res, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      path,
+			Storage:   s,
+		})
+		require.Nil(t, err)
+
+		return res.Data
+	}
+
+	// Peers are written, but the group isn't rebuilt yet
+	require.Equal(t, statePending, read("groups/mygroup")["state"])
+	require.Equal(t, statePending, read("groups/mygroup/peer1/wg-quick")["state"])
+
+	// Pending peers get their own interface, but not the other pending peers yet
+	config := read("groups/mygroup/peer1/wg-quick")["config"].(string)
+	require.Contains(t, config, "[Interface]\nAddress=10.0.0.1/24\nPrivateKey=")
+	require.NotContains(t, config, "# peer2")
+	require.Equal(t, statePending, read("groups/mygroup/peer2")["state"])
+	require.Equal(t, "10.0.0.1", read("groups/mygroup/peer1")["ip"])
+	require.Equal(t, "10.0.0.2", read("groups/mygroup/peer2")["ip"])
+
+	group, err := getGroup(context.Background(), s, "mygroup")
+	require.Nil(t, err)
+	require.Empty(t, group.Peers)
+
+	// Changes are applied once the interval has passed
+	b.materializeDue(context.Background(), s, time.Now())
+	require.Equal(t, statePending, read("groups/mygroup")["state"])
+
+	b.materializeDue(context.Background(), s, time.Now().Add(time.Minute))
+	require.Equal(t, stateSettled, read("groups/mygroup")["state"])
+	require.Equal(t, stateSettled, read("groups/mygroup/peer2")["state"])
+	require.Contains(t, read("groups/mygroup/peer1/wg-quick")["config"], "# peer2\n")
+
+	group, err = getGroup(context.Background(), s, "mygroup")
+	require.Nil(t, err)
+	require.Len(t, group.Peers, 2)
+	require.Equal(t, "10.0.0.2/24", group.Peers[1].IP)
+
+	// Deletes are pending too
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      "groups/mygroup/peer1",
+		Storage:   s,
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+	require.Equal(t, statePending, read("groups/mygroup")["state"])
+
+	b.materializeDue(context.Background(), s, time.Now().Add(time.Minute))
+
+	group, err = getGroup(context.Background(), s, "mygroup")
+	require.Nil(t, err)
+	require.Len(t, group.Peers, 1)
+	require.Equal(t, "peer2", group.Peers[0].Name)
+
+	// Group writes rebuild the group, including pending changes
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/mygroup/peer3",
+		Storage:   s,
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "groups/mygroup",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"persistent_keepalive": 25,
+		},
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+	require.Equal(t, stateSettled, read("groups/mygroup")["state"])
+	require.Empty(t, b.pendingGroups)
+
+	group, err = getGroup(context.Background(), s, "mygroup")
+	require.Nil(t, err)
+	require.Len(t, group.Peers, 2)
+	require.Equal(t, "10.0.0.1/24", group.Peers[1].IP)
+}
+
+func TestMaterializeWorker(t *testing.T) {
+	b, s := getTestBackend(t)
+	res, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/mygroup",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"materialize_interval": "1s",
+			"network":              "10.0.0.0/24",
+		},
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/mygroup/peer1",
+		Storage:   s,
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	// Pending changes left by a previous instance are picked up on initialize
+	restarted, err := newBackend(context.Background(), &logical.BackendConfig{
+		Logger:      b.Logger(),
+		StorageView: s,
+		System:      logical.TestSystemView(),
+	})
+	require.Nil(t, err)
+	require.Nil(t, restarted.Initialize(context.Background(), &logical.InitializationRequest{
+		Storage: s,
+	}))
+
+	require.Eventually(t, func() bool {
+		state, err := groupState(context.Background(), s, "mygroup")
+
+		return err == nil && state == stateSettled
+	}, 5*time.Second, 100*time.Millisecond)
+
+	restarted.Cleanup(context.Background())
+	require.Nil(t, restarted.(*wireguardBackend).materializeStop)
+
+	group, err := getGroup(context.Background(), s, "mygroup")
+	require.Nil(t, err)
+	require.Len(t, group.Peers, 1)
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/consts"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// migration upgrades the stored entries of a group from the previous schema version.  It must be safe to run again on a group that was already migrated, as a migration that was interrupted resumes with the group it stopped at.
+type migration struct {
+	Description string
+	Migrate     func(b *wireguardBackend, ctx context.Context, s logical.Storage, name string) error
+}
+
+// migrations are run in order, and migrations[i] upgrades entries to schema version i+1.
+var migrations = []migration{
+	{
+		Description: "store group networks as a list",
+		Migrate:     (*wireguardBackend).migrateGroupNetworks,
+	},
+	{
+		Description: "store addresses with each peer",
+		Migrate:     (*wireguardBackend).migratePeerAddresses,
+	},
+	{
+		Description: "remove peer secrets from group directories",
+		Migrate:     (*wireguardBackend).migrateGroupDirectory,
+	},
+	{
+		Description: "move peer secrets to creds entries",
+		Migrate:     (*wireguardBackend).migratePeerCreds,
+	},
+	{
+		Description: "split group directories into buckets",
+		Migrate:     (*wireguardBackend).migrateDirectoryBuckets,
+	},
+	{
+		Description: "store peer rotation periods in group directories",
+		Migrate:     (*wireguardBackend).migrateDirectoryRotation,
+	},
+}
+
+// schemaVersion is the version of the entries written by this version of the plugin.
+var schemaVersion = len(migrations)
+
+// wireguardSchema records the version of the stored entries, and the progress of a running migration.
+type wireguardSchema struct {
+	Migration *schemaMigration `json:"migration,omitempty"`
+	Version   int              `json:"version"`
+}
+
+// schemaMigration is the progress of a migration.  Groups are migrated in order, so LastGroup is where an interrupted migration resumes.
+type schemaMigration struct {
+	Error     string    `json:"error,omitempty"`
+	Groups    int       `json:"groups"`
+	LastGroup string    `json:"last_group"`
+	Migrated  int       `json:"migrated"`
+	StartedAt time.Time `json:"started_at"`
+	Version   int       `json:"version"`
+}
+
+func getSchema(ctx context.Context, s logical.Storage) (*wireguardSchema, error) {
+	entry, err := s.Get(ctx, "config/schema")
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving schema: %w", err)
+	}
+
+	var schema wireguardSchema
+
+	if entry == nil {
+		return &schema, nil
+	}
+
+	if err := entry.DecodeJSON(&schema); err != nil {
+		return nil, fmt.Errorf("error decoding schema data: %w", err)
+	}
+
+	return &schema, nil
+}
+
+// canMigrate reports whether this node can write to storage.  Performance standbys and secondaries leave migrations to the primary, and decode legacy entries as they are read.
+func (b *wireguardBackend) canMigrate() bool {
+	state := b.System().ReplicationState()
+
+	if state.HasState(consts.ReplicationPerformanceStandby | consts.ReplicationDRSecondary) {
+		return false
+	}
+
+	return !state.HasState(consts.ReplicationPerformanceSecondary) || b.System().LocalMount()
+}
+
+func (b *wireguardBackend) initialize(ctx context.Context, req *logical.InitializationRequest) error {
+	if !b.canMigrate() {
+		return nil
+	}
+
+	if err := b.migrate(ctx, req.Storage); err != nil {
+		return err
+	}
+
+	return b.startMaterializer(ctx, req.Storage)
+}
+
+// migrate runs the migrations from the stored schema version up to schemaVersion, recording its progress after each group.
+func (b *wireguardBackend) migrate(ctx context.Context, s logical.Storage) error {
+	schema, err := getSchema(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	if schema.Version > schemaVersion {
+		return fmt.Errorf("storage schema version %d is newer than the supported version %d", schema.Version, schemaVersion)
+	}
+
+	for schema.Version < schemaVersion {
+		version := schema.Version + 1
+
+		if schema.Migration == nil || schema.Migration.Version != version {
+			schema.Migration = &schemaMigration{
+				StartedAt: time.Now(),
+				Version:   version,
+			}
+		}
+
+		if err := b.runMigration(ctx, s, schema); err != nil {
+			schema.Migration.Error = err.Error()
+
+			if err := b.put(ctx, s, "config/schema", schema); err != nil {
+				b.Logger().Error("error recording failed migration", "version", version, "error", err)
+			}
+
+			return fmt.Errorf("error migrating to schema version %d: %w", version, err)
+		}
+
+		schema.Migration = nil
+		schema.Version = version
+
+		if err := b.put(ctx, s, "config/schema", schema); err != nil {
+			return err
+		}
+
+		b.Logger().Info("migrated storage", "version", version, "migration", migrations[version-1].Description)
+	}
+
+	return nil
+}
+
+// runMigration migrates the groups after schema.Migration.LastGroup.
+func (b *wireguardBackend) runMigration(ctx context.Context, s logical.Storage, schema *wireguardSchema) error {
+	m := migrations[schema.Migration.Version-1]
+
+	groupNames, err := listGroups(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(groupNames)
+
+	schema.Migration.Error = ""
+	schema.Migration.Groups = len(groupNames)
+
+	for _, name := range groupNames {
+		if name <= schema.Migration.LastGroup {
+			continue
+		}
+
+		if err := m.Migrate(b, ctx, s, name); err != nil {
+			return fmt.Errorf("error migrating group %s: %w", name, err)
+		}
+
+		schema.Migration.LastGroup = name
+		schema.Migration.Migrated++
+
+		if err := b.put(ctx, s, "config/schema", schema); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateGroupNetworks rewrites groups that have a single network, which are now stored as a list of networks.
+func (b *wireguardBackend) migrateGroupNetworks(ctx context.Context, s logical.Storage, name string) error {
+	lock := b.groupLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	entry, err := s.Get(ctx, "groups/"+name)
+	if err != nil {
+		return fmt.Errorf("error retrieving group: %w", err)
+	}
+
+	if entry == nil {
+		return nil
+	}
+
+	var legacy struct {
+		Network netip.Prefix `json:"network"`
+	}
+
+	if err := entry.DecodeJSON(&legacy); err != nil {
+		return fmt.Errorf("error decoding group data: %w", err)
+	}
+
+	if !legacy.Network.IsValid() {
+		return nil
+	}
+
+	group, err := getGroup(ctx, s, name)
+	if err != nil {
+		return err
+	}
+
+	return b.putGroup(ctx, s, group)
+}
+
+// migratePeerAddresses rewrites peers that have a single address, or none at all, which are now stored as a list of addresses.  Peers without an address get the address from the group directory they were rendered with.
+func (b *wireguardBackend) migratePeerAddresses(ctx context.Context, s logical.Storage, name string) error {
+	lock := b.groupLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	group, err := getGroup(ctx, s, name)
+	if err != nil {
+		return err
+	}
+
+	if group == nil {
+		return nil
+	}
+
+	peerNames, err := s.List(ctx, "groups/"+name+"/")
+	if err != nil {
+		return fmt.Errorf("error listing peers: %w", err)
+	}
+
+	ips := groupIPs(group)
+
+	for _, peerName := range peerNames {
+		if strings.HasSuffix(peerName, "/") {
+			continue
+		}
+
+		entry, err := s.Get(ctx, "groups/"+name+"/"+peerName)
+		if err != nil {
+			return fmt.Errorf("error retrieving peer: %w", err)
+		}
+
+		if entry == nil {
+			continue
+		}
+
+		var legacy struct {
+			IP  netip.Addr   `json:"ip"`
+			IPs []netip.Addr `json:"ips"`
+		}
+
+		if err := entry.DecodeJSON(&legacy); err != nil {
+			return fmt.Errorf("error decoding peer data: %w", err)
+		}
+
+		if len(legacy.IPs) > 0 && !legacy.IP.IsValid() {
+			continue
+		}
+
+		peer, err := getPeer(ctx, s, name, peerName)
+		if err != nil {
+			return err
+		}
+
+		if len(peer.IPs) == 0 {
+			peer.IPs = ips[peer.Name]
+		}
+
+		if err := b.putPeer(ctx, s, name, peerName, peer); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateGroupDirectory rewrites groups that embed the private keys and settings of their peers, which are now only stored in the peer entries.
+func (b *wireguardBackend) migrateGroupDirectory(ctx context.Context, s logical.Storage, name string) error {
+	lock := b.groupLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	entry, err := s.Get(ctx, "groups/"+name)
+	if err != nil {
+		return fmt.Errorf("error retrieving group: %w", err)
+	}
+
+	if entry == nil {
+		return nil
+	}
+
+	var legacy struct {
+		Peers []map[string]interface{} `json:"peers"`
+	}
+
+	if err := entry.DecodeJSON(&legacy); err != nil {
+		return fmt.Errorf("error decoding group data: %w", err)
+	}
+
+	migrate := false
+
+	for _, peer := range legacy.Peers {
+		for _, key := range []string{"dns", "mtu", "private_key"} {
+			if _, ok := peer[key]; ok {
+				migrate = true
+			}
+		}
+	}
+
+	if !migrate {
+		return nil
+	}
+
+	group, err := getGroup(ctx, s, name)
+	if err != nil {
+		return err
+	}
+
+	return b.putGroup(ctx, s, group)
+}
+
+// migratePeerCreds moves the private keys and preshared keys stored in peer entries to creds entries, which can be seal wrapped.
+func (b *wireguardBackend) migratePeerCreds(ctx context.Context, s logical.Storage, name string) error {
+	lock := b.groupLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	peerNames, err := s.List(ctx, "groups/"+name+"/")
+	if err != nil {
+		return fmt.Errorf("error listing peers: %w", err)
+	}
+
+	for _, peerName := range peerNames {
+		entry, err := s.Get(ctx, "groups/"+name+"/"+peerName)
+		if err != nil {
+			return fmt.Errorf("error retrieving peer: %w", err)
+		}
+
+		if entry == nil {
+			continue
+		}
+
+		var legacy wireguardPeerCreds
+
+		if err := entry.DecodeJSON(&legacy); err != nil {
+			return fmt.Errorf("error decoding peer data: %w", err)
+		}
+
+		if legacy.PrivateKey == "" && len(legacy.PresharedKeys) == 0 {
+			continue
+		}
+
+		peer, err := getPeer(ctx, s, name, peerName)
+		if err != nil {
+			return err
+		}
+
+		if err := b.putPeer(ctx, s, name, peerName, peer); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateDirectoryBuckets moves the directory embedded in the group entry to directory buckets, so peer writes don't rewrite the whole directory.
+func (b *wireguardBackend) migrateDirectoryBuckets(ctx context.Context, s logical.Storage, name string) error {
+	lock := b.groupLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	group, err := getGroup(ctx, s, name)
+	if err != nil {
+		return err
+	}
+
+	if group == nil || !group.embeddedDirectory {
+		return nil
+	}
+
+	return b.putGroup(ctx, s, group)
+}
+
+// migrateDirectoryRotation copies the rotation periods of the peers to their directory entries, so groups without rotation can be skipped without reading every peer.
+func (b *wireguardBackend) migrateDirectoryRotation(ctx context.Context, s logical.Storage, name string) error {
+	lock := b.groupLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	group, err := getGroup(ctx, s, name)
+	if err != nil || group == nil {
+		return err
+	}
+
+	names := []string{}
+
+	for i, entry := range group.Peers {
+		peer, err := getPeer(ctx, s, name, entry.Name)
+		if err != nil {
+			return err
+		}
+
+		if peer == nil || peer.RotationPeriod == entry.RotationPeriod && reflect.DeepEqual(directoryOverrides(peer.Overrides), entry.Overrides) {
+			continue
+		}
+
+		group.Peers[i].Overrides = directoryOverrides(peer.Overrides)
+		group.Peers[i].RotationPeriod = peer.RotationPeriod
+		names = append(names, entry.Name)
+	}
+
+	if len(names) == 0 {
+		return nil
+	}
+
+	return b.putGroup(ctx, s, group, names...)
+}
+
+func (b *wireguardBackend) pathSchemaRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	schema, err := getSchema(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	res := map[string]interface{}{
+		"latest_version": schemaVersion,
+		"migration":      nil,
+		"version":        schema.Version,
+	}
+
+	if schema.Migration != nil {
+		description := ""
+		if schema.Migration.Version <= schemaVersion {
+			description = migrations[schema.Migration.Version-1].Description
+		}
+
+		res["migration"] = map[string]interface{}{
+			"description": description,
+			"error":       schema.Migration.Error,
+			"groups":      schema.Migration.Groups,
+			"last_group":  schema.Migration.LastGroup,
+			"migrated":    schema.Migration.Migrated,
+			"started_at":  formatTime(schema.Migration.StartedAt),
+			"version":     schema.Migration.Version,
+		}
+	}
+
+	return &logical.Response{
+		Data: res,
+	}, nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/helper/consts"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrateGroupDirectories(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	// Groups written before secrets were removed from the directory
+	legacy := fmt.Sprintf(`{"name":"mygroup","networks":["10.0.0.0/24"],"peers":[{"name":"peer1","allowed_ips":"10.0.0.1/32","ip":"10.0.0.1/24","mtu":1280,"private_key":"%s","public_key":"%s"},{"name":"peer2","allowed_ips":"10.0.0.2/32","ip":"10.0.0.2/24","port":51820,"hostname":"peer2","private_key":"other","public_key":"other"}]}`, privateKey, publicKey)
+
+	for key, value := range map[string]string{
+		"groups/mygroup":       legacy,
+		"groups/mygroup/peer1": fmt.Sprintf(`{"name":"peer1","hostname":"peer1","ips":["10.0.0.1"],"mtu":1280,"rotation_period":3600,"private_key":"%s","public_key":"%s"}`, privateKey, publicKey),
+		"groups/mygroup/peer2": `{"name":"peer2","hostname":"peer2","ips":["10.0.0.2"],"port":51820,"private_key":"other","public_key":"other"}`,
+	} {
+		require.Nil(t, s.Put(context.Background(), &logical.StorageEntry{
+			Key:   key,
+			Value: []byte(value),
+		}))
+	}
+
+	// Standbys leave the entries alone
+	config := logical.TestBackendConfig()
+	config.StorageView = s
+	config.System = &logical.StaticSystemView{
+		ReplicationStateVal: consts.ReplicationPerformanceStandby,
+	}
+
+	standby, err := newBackend(context.Background(), config)
+	require.Nil(t, err)
+	require.Nil(t, standby.Initialize(context.Background(), &logical.InitializationRequest{
+		Storage: s,
+	}))
+
+	entry, err := s.Get(context.Background(), "groups/mygroup")
+	require.Nil(t, err)
+	require.Equal(t, legacy, string(entry.Value))
+
+	require.Nil(t, b.Initialize(context.Background(), &logical.InitializationRequest{
+		Storage: s,
+	}))
+
+	entry, err = s.Get(context.Background(), "groups/mygroup")
+	require.Nil(t, err)
+	require.NotContains(t, string(entry.Value), `"private_key":`)
+	require.NotContains(t, string(entry.Value), `"mtu":1280`)
+	require.NotContains(t, string(entry.Value), `"peers"`)
+
+	// Peer secrets are moved to creds entries
+	for _, name := range []string{"peer1", "peer2"} {
+		entry, err := s.Get(context.Background(), "groups/mygroup/"+name)
+		require.Nil(t, err)
+		require.NotContains(t, string(entry.Value), `"private_key":`)
+
+		entry, err = s.Get(context.Background(), "creds/mygroup/"+name)
+		require.Nil(t, err)
+		require.Contains(t, string(entry.Value), "private_key")
+	}
+
+	group, err := getGroup(context.Background(), s, "mygroup")
+	require.Nil(t, err)
+	require.Len(t, group.Peers, 2)
+	require.Equal(t, "10.0.0.2/24", group.Peers[1].IP)
+
+	// Rotation periods are copied to the directory
+	require.Equal(t, 3600, group.Peers[0].RotationPeriod)
+
+	group.Peers[0].RotationPeriod = 0
+	require.Nil(t, b.putGroup(context.Background(), s, group, "peer1"))
+	require.Nil(t, b.migrateDirectoryRotation(context.Background(), s, "mygroup"))
+
+	group, err = getGroup(context.Background(), s, "mygroup")
+	require.Nil(t, err)
+	require.Equal(t, 3600, group.Peers[0].RotationPeriod)
+
+	// Migrating again doesn't change anything
+	require.Nil(t, b.Initialize(context.Background(), &logical.InitializationRequest{
+		Storage: s,
+	}))
+
+	migrated, err := s.Get(context.Background(), "groups/mygroup")
+	require.Nil(t, err)
+	require.Equal(t, entry.Value, migrated.Value)
+
+	res, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "groups/mygroup/peer1/wg-quick",
+		Storage:   s,
+	})
+	require.Nil(t, err)
+	require.Equal(t, fmt.Sprintf(`# mygroup/peer1
+
+[Interface]
+Address=10.0.0.1/24
+PrivateKey=%s
+MTU=1280
+
+# peer2
+[Peer]
+PublicKey=other
+AllowedIPs=10.0.0.2/32
+Endpoint=peer2:51820
+`, privateKey), res.Data["config"])
+	require.False(t, strings.Contains(res.Data["config"].(string), "PrivateKey=other"))
+}
+
+// failingStorage fails writes and deletes of a key.
+type failingStorage struct {
+	logical.Storage
+
+	key string
+}
+
+func (s *failingStorage) Delete(ctx context.Context, key string) error {
+	if key == s.key {
+		return errors.New("storage unavailable")
+	}
+
+	return s.Storage.Delete(ctx, key)
+}
+
+func (s *failingStorage) Put(ctx context.Context, entry *logical.StorageEntry) error {
+	if entry.Key == s.key {
+		return errors.New("storage unavailable")
+	}
+
+	return s.Storage.Put(ctx, entry)
+}
+
+func TestMigrate(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	// Groups written before groups had several networks and peers stored their addresses
+	for key, value := range map[string]string{
+		"groups/group1":       `{"name":"group1","network":"10.0.0.0/24","peers":[{"name":"peer1","ip":"10.0.0.1/24"}]}`,
+		"groups/group1/peer1": `{"name":"peer1","hostname":"peer1"}`,
+		"groups/group2":       `{"name":"group2","network":"10.0.1.0/24","peers":[{"name":"peer1","ip":"10.0.1.1/24"}]}`,
+		"groups/group2/peer1": `{"name":"peer1","hostname":"peer1","ip":"10.0.1.1"}`,
+	} {
+		require.Nil(t, s.Put(context.Background(), &logical.StorageEntry{
+			Key:   key,
+			Value: []byte(value),
+		}))
+	}
+
+	readSchema := func() map[string]interface{} {
+		res, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "config/schema",
+			Storage:   s,
+		})
+		require.Nil(t, err)
+
+		return res.Data
+	}
+
+	require.Equal(t, map[string]interface{}{
+		"latest_version": 6,
+		"migration":      nil,
+		"version":        0,
+	}, readSchema())
+
+	// Interrupted migrations record their progress
+	require.NotNil(t, b.Initialize(context.Background(), &logical.InitializationRequest{
+		Storage: &failingStorage{
+			Storage: s,
+			key:     "groups/group2",
+		},
+	}))
+
+	schema := readSchema()
+	migration := schema["migration"].(map[string]interface{})
+	require.Equal(t, 0, schema["version"])
+	require.Equal(t, "store group networks as a list", migration["description"])
+	require.Equal(t, "error migrating group group2: error writing to backend: storage unavailable", migration["error"])
+	require.Equal(t, 2, migration["groups"])
+	require.Equal(t, "group1", migration["last_group"])
+	require.Equal(t, 1, migration["migrated"])
+	require.NotEqual(t, "", migration["started_at"])
+	require.Equal(t, 1, migration["version"])
+
+	// And resume where they stopped
+	require.Nil(t, b.Initialize(context.Background(), &logical.InitializationRequest{
+		Storage: s,
+	}))
+	require.Equal(t, map[string]interface{}{
+		"latest_version": 6,
+		"migration":      nil,
+		"version":        6,
+	}, readSchema())
+
+	for _, name := range []string{"group1", "group2"} {
+		entry, err := s.Get(context.Background(), "groups/"+name)
+		require.Nil(t, err)
+		require.NotContains(t, string(entry.Value), `"network"`)
+		require.Contains(t, string(entry.Value), `"networks"`)
+
+		entry, err = s.Get(context.Background(), "groups/"+name+"/peer1")
+		require.Nil(t, err)
+		require.NotContains(t, string(entry.Value), `"ip"`)
+	}
+
+	peer, err := getPeer(context.Background(), s, "group1", "peer1")
+	require.Nil(t, err)
+	require.Equal(t, "10.0.0.1", joinAddrs(peer.IPs))
+
+	peer, err = getPeer(context.Background(), s, "group2", "peer1")
+	require.Nil(t, err)
+	require.Equal(t, "10.0.1.1", joinAddrs(peer.IPs))
+
+	// Mounts written by newer versions aren't changed
+	require.Nil(t, b.put(context.Background(), s, "config/schema", &wireguardSchema{
+		Version: schemaVersion + 1,
+	}))
+	require.NotNil(t, b.Initialize(context.Background(), &logical.InitializationRequest{
+		Storage: s,
+	}))
+}
@@ -7,6 +7,144 @@ import (
 
 func paths(b *wireguardBackend) []*framework.Path {
 	return []*framework.Path{
+		{
+			Pattern: "config$",
+			Fields: map[string]*framework.FieldSchema{
+				"dns": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Default DNS servers for peer configs.",
+				},
+				"inherit": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Settings to unset, so the default value is used again.",
+				},
+				"key_policy": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Default key policy for peers.  Either generate (default), which generates a private key if no keys are provided, provided, which requires a private_key or public_key to be provided, or client, which requires a public_key and never stores private keys.",
+				},
+				"materialize_interval": {
+					Type:        framework.TypeDurationSecond,
+					Description: "Default interval for applying peer changes to groups in the background.  Peer writes only record the change, and groups are rebuilt at most once per interval.  If not set or set to 0, groups are updated by each peer write.",
+				},
+				"max_ttl": {
+					Type:        framework.TypeDurationSecond,
+					Description: "Default maximum lease for generated configs.  If not set, will be 1m.  Setting 0 returns a max_ttl of 0, until max_ttl is inherited again.",
+				},
+				"mtu": {
+					Type:        framework.TypeInt,
+					Description: "Default MTU for peer configs.  If not set or set to 0, wg-quick will choose one.",
+				},
+				"persistent_keepalive": {
+					Type:        framework.TypeInt,
+					Description: "Default PersistentKeepalive for peers without a port.",
+				},
+				"port": {
+					Type:        framework.TypeInt,
+					Description: "Default Wireguard listening port for peers.",
+				},
+				"preshared_keys": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Default preshared key mode for groups.  Either none (default), pair, which generates a preshared key for each pair of peers, or group, which uses a single preshared key for the whole group.",
+				},
+				"private_key_file": {
+					Type:        framework.TypeString,
+					Description: "Default file that peers without a stored private key read it from.  Configs of these peers set the key with a PostUp command, or contain a placeholder if no file is set.",
+				},
+				"rotation_period": {
+					Type:        framework.TypeDurationSecond,
+					Description: "Default period after which generated peer keys are rotated.  If not set or set to 0, keys won't be rotated.",
+				},
+				"ttl": {
+					Type:        framework.TypeDurationSecond,
+					Description: "Default lease for generated configs.  If not set, will be 1m.  Setting 0 returns a ttl of 0, until ttl is inherited again.",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathConfigRead,
+				},
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathConfigWrite,
+				},
+			},
+			HelpSynopsis:    "Manage the engine defaults for groups and peers",
+			HelpDescription: "Manage engine config",
+		},
+		{
+			Pattern: "config/address_space$",
+			Fields: map[string]*framework.FieldSchema{
+				"networks": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Supernets that group networks can be allocated from.  If no IPv6 network is provided, a random IPv6 ULA /48 will be generated.",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathAddressSpaceRead,
+				},
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathAddressSpaceWrite,
+				},
+			},
+			HelpSynopsis:    "Manage the address space group networks are allocated from",
+			HelpDescription: "Manage address space",
+		},
+		{
+			Pattern: "config/schema$",
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathSchemaRead,
+				},
+			},
+			HelpSynopsis:    "Read the storage schema version and the progress of any running migration",
+			HelpDescription: "Read storage schema",
+		},
+		{
+			Pattern: "config/tidy$",
+			Fields: map[string]*framework.FieldSchema{
+				"interval": {
+					Type:        framework.TypeDurationSecond,
+					Description: "Interval for running tidy in the background.  If not set or set to 0, tidy only runs when requested.",
+				},
+				"remove_expired_peers": {
+					Type:        framework.TypeBool,
+					Description: "Whether background tidies delete peers whose key is older than their rotation_period and can't be rotated, because the private key isn't stored.",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathTidyConfigRead,
+				},
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathTidyConfigWrite,
+				},
+			},
+			HelpSynopsis:    "Manage running tidy in the background",
+			HelpDescription: "Manage tidy config",
+		},
+		{
+			Pattern: "tidy$",
+			Fields: map[string]*framework.FieldSchema{
+				"dry_run": {
+					Type:        framework.TypeBool,
+					Description: "Report what would be repaired without changing anything.",
+				},
+				"remove_expired_peers": {
+					Type:        framework.TypeBool,
+					Description: "Delete peers whose key is older than their rotation_period and can't be rotated, because the private key isn't stored.",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathTidyRead,
+				},
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathTidyWrite,
+				},
+			},
+			HelpSynopsis:    "Find and repair orphaned and inconsistent storage entries",
+			HelpDescription: "Tidy storage.  Reading returns the report of the last tidy that wasn't a dry run.",
+		},
 		{
 			Pattern: "groups" + "/?$",
 			Operations: map[logical.Operation]framework.OperationHandler{
@@ -25,22 +163,86 @@ func paths(b *wireguardBackend) []*framework.Path {
 					Description: "Name of the group",
 					Required:    true,
 				},
-				"network": {
+				"access_rules": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Rules deciding which peers can reach each other, in the form \"<allow|deny> <from> <to>\".  Peers are selected with *, label:<label> or their name.  The first matching rule wins, and rules apply in both directions.  Peers that can't reach each other don't get each other's [Peer] section.",
+				},
+				"default_access": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Whether peers can reach each other when no access rule matches.  Either allow (default) or deny.",
+				},
+				"ipam_mode": {
 					Type:        framework.TypeLowerCaseString,
-					Description: "The network the group will have IP addresses on.  Must be in the form of a valid IPv4 (1.1.1.1/24) or IPv6 (a:b:c::/64) prefix.  Ensure the network is big enough for the number of peers in the group + 2.",
+					Description: "How peer addresses are allocated.  Either sequential (default), which uses the lowest free address, or key, which derives the address from a SHA-256 hash of the peer's public key so it can be worked out offline.  In key mode, peers get a new address when their key changes.",
+				},
+				"network": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "The networks the group will have IP addresses on.  Must be a valid IPv4 (1.1.1.1/24) or IPv6 (a:b:c::/64) prefix, or one of each for a dual-stack group.  A prefix length like /24 will allocate a free network of that size from the engine address space.  Networks can't overlap the networks of other groups or the allowed_ips of any peer.  Ensure the networks are big enough for the number of peers in the group + 2.",
 					Required:    true,
 				},
+				"delegation_network": {
+					Type:        framework.TypeString,
+					Description: "Supernet to delegate a prefix to each peer from, like a /64 from a /48 for routers or a pod range for Kubernetes nodes.  Delegated prefixes are added to the peer's AllowedIPs.  Set to an empty string to stop delegating prefixes.",
+				},
+				"delegation_prefix_length": {
+					Type:        framework.TypeInt,
+					Description: "Length of the prefix delegated to each peer from delegation_network.",
+				},
+				"dns": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Override the default engine DNS servers for this group.",
+				},
+				"inherit": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Settings to unset, so the engine value is used again.",
+				},
+				"key_policy": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Override the default engine key policy for this group.",
+				},
+				"materialize_interval": {
+					Type:        framework.TypeDurationSecond,
+					Description: "Override the default engine interval for applying peer changes to this group in the background.",
+				},
+				"mtu": {
+					Type:        framework.TypeInt,
+					Description: "Override the default engine MTU for this group.",
+				},
 				"persistent_keepalive": {
 					Type:        framework.TypeInt,
 					Description: "Override the default engine PersistentKeepalive value for this group.",
 				},
+				"port": {
+					Type:        framework.TypeInt,
+					Description: "Override the default engine Wireguard listening port for this group.",
+				},
+				"preshared_keys": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Override the default engine preshared key mode for this group.",
+				},
+				"reserved_ranges": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "List of prefixes within the network that won't be automatically allocated to peers.  Peers can still be given an address in these ranges using ip.",
+				},
+				"private_key_file": {
+					Type:        framework.TypeString,
+					Description: "Override the default engine private key file for this group.",
+				},
+				"rotation_period": {
+					Type:        framework.TypeDurationSecond,
+					Description: "Override the default engine key rotation period for this group.",
+				},
+				"topology": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "How peers are connected.  Either full_mesh (default), where every peer gets every other peer, or hub_spoke, where hubs get every peer and the other peers only get the hubs, routing the group networks through the first hub.",
+				},
 				"ttl": {
 					Type:        framework.TypeDurationSecond,
-					Description: "Default lease for generated configs. If not set or set to 0, will be 1m.",
+					Description: "Override the default engine lease for generated configs.  Setting 0 also overrides it, until ttl is inherited again.",
 				},
 				"max_ttl": {
 					Type:        framework.TypeDurationSecond,
-					Description: "Maximum time for role. If not set or set to 0, will be 1.",
+					Description: "Override the default engine maximum lease for generated configs.  Setting 0 also overrides it, until max_ttl is inherited again.",
 				},
 			},
 			Operations: map[logical.Operation]framework.OperationHandler{
@@ -63,6 +265,60 @@ func paths(b *wireguardBackend) []*framework.Path {
 			HelpSynopsis:    "Manage Wireguard groups which contain Wireguard peers",
 			HelpDescription: "Manage groups",
 		},
+		{
+			Pattern: "renumber/" + framework.GenericNameRegex("name") + "$",
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the group to renumber.",
+					Required:    true,
+				},
+				"network": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "The new networks for the group, in the same format as the group network.",
+					Required:    true,
+				},
+				"confirm": {
+					Type:        framework.TypeBool,
+					Description: "Apply the renumber.  If not set, only the plan will be returned.",
+				},
+				"transition": {
+					Type:        framework.TypeBool,
+					Description: "Keep the old addresses on the peers alongside the new ones until the renumber is deleted.",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathRenumberWrite,
+				},
+				logical.DeleteOperation: &framework.PathOperation{
+					Callback: b.pathRenumberDelete,
+				},
+			},
+			HelpSynopsis:    "Plan and apply a new network for a group, mapping each peer's old address to a new one.  Deleting finishes a transition by removing the old addresses.",
+			HelpDescription: "Renumber a group",
+		},
+		{
+			Pattern: "rotate-psk/" + framework.GenericNameRegex("name") + "$",
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the group to rotate preshared keys for.",
+					Required:    true,
+				},
+				"peers": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Limit the rotation to the keys of one peer, or the key of a pair of peers.  If not provided, all keys in the group will be rotated.",
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathPSKRotateWrite,
+				},
+			},
+			HelpSynopsis:    "Rotate the preshared keys of a group",
+			HelpDescription: "Rotate preshared keys",
+		},
 		{
 			Pattern: "groups/" + framework.GenericNameRegex("name") + "/?$",
 			Fields: map[string]*framework.FieldSchema{
@@ -97,22 +353,86 @@ func paths(b *wireguardBackend) []*framework.Path {
 					Type:        framework.TypeCommaStringSlice,
 					Description: "List of additional AllowedIPs for the peer.  Must be valid IP prefixes.  Will include the Peer's assigned IP by default.",
 				},
+				"dns": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Override the DNS servers for this peer's config.",
+				},
+				"endpoints": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Addresses the peer can be reached on, in the form [site=]host:port.  IPv6 addresses must be in brackets, like [fd00::1]:51820.  Peers in the same site use the endpoints of their site first, then the endpoints without a site, and then hostname and port.",
+				},
+				"exit_node": {
+					Type:        framework.TypeBool,
+					Description: "Whether peers using a full tunnel can send all of their traffic through this peer.  Exit nodes need a port, and their config enables IP forwarding and NAT for the group networks.",
+				},
 				"hostname": {
 					Type:        framework.TypeLowerCaseString,
 					Description: "Hostname of the peer.  If a port is provided, will be combined with port as an endpoint, otherwise will just be used as a client.  If not specified, will use name.",
 				},
+				"hub": {
+					Type:        framework.TypeBool,
+					Description: "Whether the peer is a hub in a hub_spoke group.  Hubs get every peer in their config, and should forward traffic between the other peers.",
+				},
+				"inherit": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Settings to unset, so the group or engine value is used again.",
+				},
+				"ip": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Static addresses for the peer, at most one per group network.  Must be within the group network and not used by another peer.  Addresses not provided will be allocated automatically.",
+				},
+				"key_policy": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Override the key policy for this peer.  With client, the peer holds its own private key: a public_key is required and a private_key is never stored.",
+				},
+				"labels": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Labels of the peer, used to select it in the group access_rules.",
+				},
+				"mtu": {
+					Type:        framework.TypeInt,
+					Description: "Override the MTU for this peer's config.",
+				},
+				"persistent_keepalive": {
+					Type:        framework.TypeInt,
+					Description: "Override the PersistentKeepalive value for this peer.",
+				},
 				"port": {
 					Type:        framework.TypeInt,
-					Description: "Wireguard listening port, if not provided the peer will not be registered as an endpoint.",
+					Description: "Wireguard listening port, if not provided the group or engine default will be used.  If there is no port, the peer will not be registered as an endpoint.",
 				},
 				"private_key": {
 					Type:        framework.TypeString,
 					Description: "Wireguard private key, if not provided one will be generated",
 				},
+				"private_key_file": {
+					Type:        framework.TypeString,
+					Description: "Override the file this peer reads its private key from, if it isn't stored.",
+				},
 				"public_key": {
 					Type:        framework.TypeString,
 					Description: "Wireguard public key, if not provided one will be generated",
 				},
+				"relay": {
+					Type:        framework.TypeBool,
+					Description: "Whether the peer relays traffic between peers that can't connect directly, like two peers without a port behind NAT.  Relays need a port, and their config enables IP forwarding.",
+				},
+				"rotation_period": {
+					Type:        framework.TypeDurationSecond,
+					Description: "Override the key rotation period for this peer.",
+				},
+				"site": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Site of the peer, like an office or data center.  The peer uses the endpoints of other peers in the same site first.",
+				},
+				"table": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Routing table wg-quick adds the routes of this peer's config to.  Either auto (default), off or a table number.",
+				},
+				"tunnel": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Either split (default), which only routes the group through the tunnel, or full, which routes all traffic through the first exit node the peer can reach.",
+				},
 			},
 			Operations: map[logical.Operation]framework.OperationHandler{
 				logical.ReadOperation: &framework.PathOperation{
@@ -131,6 +451,77 @@ func paths(b *wireguardBackend) []*framework.Path {
 			HelpSynopsis:    "Manage Wireguard peer configurations",
 			HelpDescription: "Manage peers",
 		},
+		{
+			Pattern: "groups/" + framework.GenericNameRegex("group_name") + "/" + framework.GenericNameRegex("name") + "/creds$",
+			Fields: map[string]*framework.FieldSchema{
+				"group_name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Group name for peer.",
+					Required:    true,
+				},
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name for peer.",
+					Required:    true,
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathPeersCredsRead,
+				},
+			},
+			HelpSynopsis:    "Read the private key of a peer",
+			HelpDescription: "Read peer creds",
+		},
+		{
+			Pattern: "groups/" + framework.GenericNameRegex("group_name") + "/" + framework.GenericNameRegex("name") + "/access/" + framework.GenericNameRegex("peer") + "$",
+			Fields: map[string]*framework.FieldSchema{
+				"group_name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Group name for peer.",
+					Required:    true,
+				},
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the peer reaching the other peer.",
+					Required:    true,
+				},
+				"peer": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the peer being reached.",
+					Required:    true,
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.ReadOperation: &framework.PathOperation{
+					Callback: b.pathPeersAccessRead,
+				},
+			},
+			HelpSynopsis:    "Check whether a peer can reach another peer",
+			HelpDescription: "Returns whether the group access rules allow a peer to reach another peer, and the rule that decided it.  The rule is default if no access rule matched.",
+		},
+		{
+			Pattern: "groups/" + framework.GenericNameRegex("group_name") + "/" + framework.GenericNameRegex("name") + "/rotate$",
+			Fields: map[string]*framework.FieldSchema{
+				"group_name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Group name for peer.",
+					Required:    true,
+				},
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name for peer.",
+					Required:    true,
+				},
+			},
+			Operations: map[logical.Operation]framework.OperationHandler{
+				logical.UpdateOperation: &framework.PathOperation{
+					Callback: b.pathRotateWrite,
+				},
+			},
+			HelpSynopsis:    "Rotate the key of a peer",
+			HelpDescription: "Rotate peer key",
+		},
 		{
 			Pattern: "groups/" + framework.GenericNameRegex("group_name") + "/" + framework.GenericNameRegex("name") + "/wg-quick$",
 			Fields: map[string]*framework.FieldSchema{
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	accessAllow = "allow"
+	accessDeny  = "deny"
+)
+
+// accessRuleDefault is the rule reported when no access rule matches a pair of peers.
+const accessRuleDefault = "default"
+
+// accessRule allows or denies the peers matched by From to reach the peers matched by To.  Selectors are either *, label:<label> or a peer name.
+type accessRule struct {
+	Action string `json:"action"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+}
+
+// parseAccessRule parses a rule in the form "<allow|deny> <selector> <selector>".
+func parseAccessRule(value string) (accessRule, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 3 {
+		return accessRule{}, fmt.Errorf("rule %q must be in the form \"<allow|deny> <from> <to>\"", value)
+	}
+
+	rule := accessRule{
+		Action: strings.ToLower(fields[0]),
+		From:   fields[1],
+		To:     fields[2],
+	}
+
+	if rule.Action != accessAllow && rule.Action != accessDeny {
+		return accessRule{}, fmt.Errorf("unknown action in rule %q: %s", value, fields[0])
+	}
+
+	for _, selector := range []string{rule.From, rule.To} {
+		if selector == "label:" {
+			return accessRule{}, fmt.Errorf("missing label in rule %q", value)
+		}
+	}
+
+	return rule, nil
+}
+
+func (r accessRule) String() string {
+	return r.Action + " " + r.From + " " + r.To
+}
+
+// selectorMatches reports whether the selector matches the peer.
+func selectorMatches(selector string, peer wireguardGroupPeer) bool {
+	if selector == "*" {
+		return true
+	}
+
+	if strings.HasPrefix(selector, "label:") {
+		label := strings.TrimPrefix(selector, "label:")
+
+		for _, l := range peer.Labels {
+			if l == label {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return selector == peer.Name
+}
+
+// matches reports whether the rule applies to a pair of peers.  A tunnel needs both peers to have each other's [Peer] section, so rules apply in both directions.
+func (r accessRule) matches(a, b wireguardGroupPeer) bool {
+	return (selectorMatches(r.From, a) && selectorMatches(r.To, b)) || (selectorMatches(r.From, b) && selectorMatches(r.To, a))
+}
+
+// restrictsAccess reports whether the group access rules can deny any pair of peers.
+func (g *wireguardGroup) restrictsAccess() bool {
+	return len(g.AccessRules) > 0 || g.DefaultAccess == accessDeny
+}
+
+// access reports whether peer a can reach peer b, and the rule that decided it.  The first matching rule wins, and the group default_access is used if none match.
+func (g *wireguardGroup) access(a, b wireguardGroupPeer) (bool, string) {
+	if a.Name == b.Name {
+		return true, accessRuleDefault
+	}
+
+	for _, rule := range g.AccessRules {
+		if rule.matches(a, b) {
+			return rule.Action == accessAllow, rule.String()
+		}
+	}
+
+	return g.DefaultAccess != accessDeny, accessRuleDefault
+}
+
+// accessPeer returns the directory entry of a peer, falling back to its stored entry if it hasn't been added to the directory yet.  Returns nil if the peer doesn't exist.
+func accessPeer(ctx context.Context, s logical.Storage, group *wireguardGroup, name string) (*wireguardGroupPeer, error) {
+	if peer, ok := directoryPeer(group, name); ok {
+		return &peer, nil
+	}
+
+	peer, err := getPeer(ctx, s, group.Name, name)
+	if err != nil || peer == nil {
+		return nil, err
+	}
+
+	return &wireguardGroupPeer{
+		Hub:    peer.Hub,
+		Labels: peer.Labels,
+		Name:   name,
+		Relay:  peer.Relay,
+	}, nil
+}
+
+// pathPeersAccessRead returns whether a peer can reach another peer, and the rule that decided it.
+func (b *wireguardBackend) pathPeersAccessRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	groupname := data.Get("group_name").(string)
+
+	lock := b.groupLock(groupname)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	group, err := b.getCachedGroup(ctx, req.Storage, groupname)
+	if err != nil || group == nil {
+		return logical.ErrorResponse("missing group"), err
+	}
+
+	peers := make([]*wireguardGroupPeer, 2)
+
+	for i, name := range []string{data.Get("name").(string), data.Get("peer").(string)} {
+		peers[i], err = accessPeer(ctx, req.Storage, group, name)
+		if err != nil {
+			return nil, err
+		}
+
+		if peers[i] == nil {
+			return logical.ErrorResponse(fmt.Sprintf("missing peer %s", name)), nil
+		}
+	}
+
+	allowed, rule := group.access(*peers[0], *peers[1])
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"allowed": allowed,
+			"rule":    rule,
+		},
+	}, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccess(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	write := func(path string, data map[string]interface{}) *logical.Response {
+		res, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Storage:   s,
+			Data:      data,
+		})
+		require.Nil(t, err)
+
+		return res
+	}
+
+	read := func(path string) *logical.Response {
+		res, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      path,
+			Storage:   s,
+		})
+		require.Nil(t, err)
+
+		return res
+	}
+
+	require.Nil(t, write("groups/mygroup", map[string]interface{}{
+		"access_rules":   "allow label:ci-runners build-cache",
+		"default_access": "deny",
+		"network":        "10.0.0.0/24",
+	}))
+
+	res := write("groups/mygroup", map[string]interface{}{
+		"access_rules": "permit * *",
+	})
+	require.Equal(t, `error parsing access_rules: unknown action in rule "permit * *": permit`, res.Error().Error())
+
+	res = write("groups/mygroup", map[string]interface{}{
+		"access_rules": "allow runner1",
+	})
+	require.Equal(t, `error parsing access_rules: rule "allow runner1" must be in the form "<allow|deny> <from> <to>"`, res.Error().Error())
+
+	res = write("groups/mygroup", map[string]interface{}{
+		"default_access": "maybe",
+	})
+	require.Equal(t, "unknown default_access: maybe", res.Error().Error())
+
+	group := read("groups/mygroup")
+	require.Equal(t, []string{"allow label:ci-runners build-cache"}, group.Data["access_rules"])
+	require.Equal(t, "deny", group.Data["default_access"])
+
+	require.Nil(t, write("groups/mygroup/runner1", map[string]interface{}{
+		"labels": "ci-runners",
+	}))
+	require.Nil(t, write("groups/mygroup/runner2", map[string]interface{}{
+		"labels": "ci-runners",
+	}))
+	require.Nil(t, write("groups/mygroup/build-cache", map[string]interface{}{
+		"port": 51820,
+	}))
+	require.Equal(t, []string{"ci-runners"}, read("groups/mygroup/runner1").Data["labels"])
+
+	config := read("groups/mygroup/runner1/wg-quick").Data["config"].(string)
+	require.Contains(t, config, "# build-cache\n")
+	require.NotContains(t, config, "# runner2\n")
+
+	config = read("groups/mygroup/build-cache/wg-quick").Data["config"].(string)
+	require.Contains(t, config, "# runner1\n")
+	require.Contains(t, config, "# runner2\n")
+
+	require.Equal(t, map[string]interface{}{
+		"allowed": true,
+		"rule":    "allow label:ci-runners build-cache",
+	}, read("groups/mygroup/runner1/access/build-cache").Data)
+	require.Equal(t, map[string]interface{}{
+		"allowed": true,
+		"rule":    "allow label:ci-runners build-cache",
+	}, read("groups/mygroup/build-cache/access/runner2").Data)
+	require.Equal(t, map[string]interface{}{
+		"allowed": false,
+		"rule":    "default",
+	}, read("groups/mygroup/runner1/access/runner2").Data)
+	require.Equal(t, "missing peer runner3", read("groups/mygroup/runner1/access/runner3").Error().Error())
+
+	// The first matching rule wins
+	require.Nil(t, write("groups/mygroup", map[string]interface{}{
+		"access_rules": "deny runner2 *,allow label:ci-runners build-cache,allow runner1 runner2",
+	}))
+	require.Equal(t, map[string]interface{}{
+		"allowed": false,
+		"rule":    "deny runner2 *",
+	}, read("groups/mygroup/build-cache/access/runner2").Data)
+	require.NotContains(t, read("groups/mygroup/runner2/wg-quick").Data["config"], "[Peer]")
+
+	// Spokes only route the peers they can reach through the hub
+	require.Nil(t, write("groups/mygroup", map[string]interface{}{
+		"access_rules": "allow label:ci-runners build-cache,allow runner1 runner2",
+		"topology":     "hub_spoke",
+	}))
+	require.Nil(t, write("groups/mygroup/build-cache", map[string]interface{}{
+		"hub":  true,
+		"port": 51820,
+	}))
+
+	config = read("groups/mygroup/runner1/wg-quick").Data["config"].(string)
+	require.Contains(t, config, "AllowedIPs=10.0.0.3/32,10.0.0.2/32\n")
+	require.NotContains(t, config, "# runner2\n")
+
+	require.Nil(t, write("groups/mygroup", map[string]interface{}{
+		"access_rules": "allow label:ci-runners build-cache",
+	}))
+	require.Contains(t, read("groups/mygroup/runner1/wg-quick").Data["config"], "AllowedIPs=10.0.0.3/32\n")
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+type wireguardAddressSpace struct {
+	Networks []netip.Prefix `json:"networks"`
+}
+
+func getAddressSpace(ctx context.Context, s logical.Storage) (*wireguardAddressSpace, error) {
+	entry, err := s.Get(ctx, "config/address_space")
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving address space: %w", err)
+	}
+
+	var space wireguardAddressSpace
+
+	if entry == nil {
+		return &space, nil
+	}
+
+	if err := entry.DecodeJSON(&space); err != nil {
+		return nil, fmt.Errorf("error decoding address space data: %w", err)
+	}
+
+	return &space, nil
+}
+
+// ensureULA adds a generated IPv6 ULA network to the address space if it doesn't have an IPv6 network.  Returns true if the address space was changed.
+func ensureULA(space *wireguardAddressSpace) (bool, error) {
+	for _, network := range space.Networks {
+		if network.Addr().Is6() {
+			return false, nil
+		}
+	}
+
+	ula, err := generateULA()
+	if err != nil {
+		return false, fmt.Errorf("error generating ULA network: %w", err)
+	}
+
+	space.Networks = append(space.Networks, ula)
+
+	return true, nil
+}
+
+// addressSpaceUsage returns the networks used by groups other than the named group, including networks kept during a renumber transition, and the allowed_ips of every peer except default routes.
+func addressSpaceUsage(ctx context.Context, s logical.Storage, except string) (networks, routes []ownedPrefix, err error) {
+	groupNames, err := listGroups(ctx, s)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, groupName := range groupNames {
+		// The route index is enough, so directories are only read for groups written before it
+		group, err := getGroupEntry(ctx, s, groupName)
+		if err == nil && group != nil && group.PeerRoutes == nil {
+			group, err = getGroup(ctx, s, groupName)
+		}
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if group == nil {
+			continue
+		}
+
+		if groupName != except {
+			for _, network := range group.Networks {
+				networks = append(networks, ownedPrefix{
+					Owner:  "network of group " + groupName,
+					Prefix: network,
+				})
+			}
+
+			// Peers keep their previous addresses until a renumber transition is finished
+			for _, network := range group.PreviousNetworks {
+				networks = append(networks, ownedPrefix{
+					Owner:  "previous network of group " + groupName,
+					Prefix: network,
+				})
+			}
+
+			if group.DelegationNetwork.IsValid() {
+				networks = append(networks, ownedPrefix{
+					Owner:  "delegation_network of group " + groupName,
+					Prefix: group.DelegationNetwork,
+				})
+			}
+		}
+
+		peerNames := make([]string, 0, len(group.PeerRoutes))
+		for peerName := range group.PeerRoutes {
+			peerNames = append(peerNames, peerName)
+		}
+
+		sort.Strings(peerNames)
+
+		for _, peerName := range peerNames {
+			for _, prefix := range group.PeerRoutes[peerName] {
+				// Default routes overlap every network, and wireguard prefers the more specific routes of the other peers
+				if prefix.Bits() == 0 {
+					continue
+				}
+
+				routes = append(routes, ownedPrefix{
+					Owner:  "allowed_ips of peer " + groupName + "/" + peerName,
+					Peer:   groupName + "/" + peerName,
+					Prefix: prefix,
+				})
+			}
+		}
+	}
+
+	return networks, routes, nil
+}
+
+// parseGroupNetworks parses the network values for a group.  Values in the form of /<prefix length> are allocated from the address space, unless current already has a network of that length.  A generated ULA network is only saved to the address space if persist is set.
+func (b *wireguardBackend) parseGroupNetworks(ctx context.Context, s logical.Storage, values []string, current []netip.Prefix, taken []ownedPrefix, persist bool) ([]string, error) {
+	var space *wireguardAddressSpace
+
+	networks := make([]string, len(values))
+
+	for i, value := range values {
+		if !strings.HasPrefix(value, "/") {
+			networks[i] = value
+
+			continue
+		}
+
+		bits, err := strconv.Atoi(strings.TrimPrefix(value, "/"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefix length %s", value)
+		}
+
+		for _, network := range current {
+			if network.Bits() == bits {
+				networks[i] = network.String()
+			}
+		}
+
+		if networks[i] != "" {
+			continue
+		}
+
+		if space == nil {
+			space, err = getAddressSpace(ctx, s)
+			if err != nil {
+				return nil, err
+			}
+
+			changed, err := ensureULA(space)
+			if err != nil {
+				return nil, err
+			}
+
+			if changed && persist {
+				if err := b.put(ctx, s, "config/address_space", space); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		for _, supernet := range space.Networks {
+			if bits < supernet.Bits() || bits > supernet.Addr().BitLen() {
+				continue
+			}
+
+			if prefix, err := allocateFreePrefix(supernet, bits, taken); err == nil {
+				networks[i] = prefix.String()
+				taken = append(taken, ownedPrefix{
+					Prefix: prefix,
+				})
+
+				break
+			}
+		}
+
+		if networks[i] == "" {
+			return nil, fmt.Errorf("no free %s left in the address space", value)
+		}
+	}
+
+	return networks, nil
+}
+
+func (b *wireguardBackend) pathAddressSpaceRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	space, err := getAddressSpace(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	networks := make([]string, len(space.Networks))
+	for i := range space.Networks {
+		networks[i] = space.Networks[i].String()
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"networks": networks,
+		},
+	}, nil
+}
+
+func (b *wireguardBackend) pathAddressSpaceWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.configLock.Lock()
+	defer b.configLock.Unlock()
+
+	space := &wireguardAddressSpace{}
+
+	prefixes, err := parsePrefixes(data.Get("networks").([]string))
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("error parsing networks: %s", err)), nil
+	}
+
+	for i := range prefixes {
+		for j := range prefixes[:i] {
+			if prefixes[i].Overlaps(prefixes[j]) {
+				return logical.ErrorResponse(fmt.Sprintf("network %s overlaps network %s", prefixes[i], prefixes[j])), nil
+			}
+		}
+	}
+
+	space.Networks = prefixes
+
+	if _, err := ensureULA(space); err != nil {
+		return nil, err
+	}
+
+	if err := b.put(ctx, req.Storage, "config/address_space", space); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddressSpace(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	// Write
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config/address_space",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"networks": "10.0.0.0/8,10.1.0.0/16",
+		},
+	}
+
+	res, err := b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Equal(t, "network 10.1.0.0/16 overlaps network 10.0.0.0/8", res.Error().Error())
+
+	req.Data["networks"] = "10.0.0.0/8"
+	res, err = b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	// Read
+	req = &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "config/address_space",
+		Storage:   s,
+	}
+
+	res, err = b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+
+	networks := res.Data["networks"].([]string)
+	require.Len(t, networks, 2)
+	require.Equal(t, "10.0.0.0/8", networks[0])
+
+	ula := netip.MustParsePrefix(networks[1])
+	require.Equal(t, 48, ula.Bits())
+	require.True(t, netip.MustParsePrefix("fd00::/8").Contains(ula.Addr()))
+
+	// Allocate group networks
+	req = &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/mygroup1",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"network": "10.0.0.0/24",
+		},
+	}
+
+	res, err = b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	req = &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/mygroup1/peer1",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"allowed_ips": "10.0.1.0/24",
+		},
+	}
+
+	res, err = b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	// Default routes and routes within the group network don't conflict
+	req.Data["allowed_ips"] = "10.0.1.0/24,10.0.0.128/25,0.0.0.0/0"
+	res, err = b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	// Which also doesn't stop the group from being written again
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "groups/mygroup1",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"network": "10.0.0.0/24",
+		},
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	req = &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/mygroup2",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"network": "10.0.1.0/24",
+		},
+	}
+
+	res, err = b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Equal(t, "network 10.0.1.0/24 overlaps allowed_ips of peer mygroup1/peer1", res.Error().Error())
+
+	req.Data["network"] = "/24,/64"
+	res, err = b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	req = &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "groups/mygroup2",
+		Storage:   s,
+	}
+
+	res, err = b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Equal(t, "10.0.2.0/24,"+netip.PrefixFrom(ula.Addr(), 64).String(), res.Data["network"])
+
+	// Asking for the same size again keeps the network
+	req = &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "groups/mygroup2",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"network": "/24",
+		},
+	}
+
+	res, err = b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	req = &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "groups/mygroup2",
+		Storage:   s,
+	}
+
+	res, err = b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Equal(t, "10.0.2.0/24", res.Data["network"])
+
+	req = &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "groups/mygroup1/peer1",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"allowed_ips": "10.0.2.128/25",
+		},
+	}
+
+	res, err = b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Equal(t, "allowed_ips 10.0.2.128/25 overlaps network of group mygroup2", res.Error().Error())
+
+	req = &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/mygroup3",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"network": "/4",
+		},
+	}
+
+	res, err = b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Equal(t, "error allocating network: no free /4 left in the address space", res.Error().Error())
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+type wireguardConfig struct {
+	DNS                 []string `json:"dns"`
+	KeyPolicy           string   `json:"key_policy"`
+	MaterializeInterval int      `json:"materialize_interval"`
+	MaxTTL              int      `json:"max_ttl"`
+	MTU                 int      `json:"mtu"`
+	Overrides           []string `json:"overrides"`
+	PersistentKeepalive int      `json:"persistent_keepalive"`
+	Port                int      `json:"port"`
+	PresharedKeys       string   `json:"preshared_keys"`
+	PrivateKeyFile      string   `json:"private_key_file"`
+	RotationPeriod      int      `json:"rotation_period"`
+	TTL                 int      `json:"ttl"`
+}
+
+func getConfig(ctx context.Context, s logical.Storage) (*wireguardConfig, error) {
+	entry, err := s.Get(ctx, "config")
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving config: %w", err)
+	}
+
+	var config wireguardConfig
+
+	if entry == nil {
+		return &config, nil
+	}
+
+	if err := entry.DecodeJSON(&config); err != nil {
+		return nil, fmt.Errorf("error decoding config data: %w", err)
+	}
+
+	return &config, nil
+}
+
+func (c *wireguardConfig) settingsLayer() settingsLayer {
+	return settingsLayer{
+		Overrides: c.Overrides,
+		Source:    settingsSourceConfig,
+		Values: map[string]interface{}{
+			"dns":                  c.DNS,
+			"key_policy":           c.KeyPolicy,
+			"materialize_interval": c.MaterializeInterval,
+			"max_ttl":              c.MaxTTL,
+			"mtu":                  c.MTU,
+			"persistent_keepalive": c.PersistentKeepalive,
+			"port":                 c.Port,
+			"preshared_keys":       c.PresharedKeys,
+			"private_key_file":     c.PrivateKeyFile,
+			"rotation_period":      c.RotationPeriod,
+			"ttl":                  c.TTL,
+		},
+	}
+}
+
+// settingsResponse adds the effective settings to data, along with where each one came from.  If keys are provided, only those settings are added.
+func settingsResponse(s *settings, data map[string]interface{}, keys ...string) map[string]interface{} {
+	if len(keys) == 0 {
+		for key := range s.Values {
+			keys = append(keys, key)
+		}
+	}
+
+	sources := map[string]string{}
+
+	for _, key := range keys {
+		data[key] = s.Values[key]
+		sources[key] = s.Sources[key]
+	}
+
+	data["sources"] = sources
+
+	return data
+}
+
+func (b *wireguardBackend) pathConfigRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: settingsResponse(resolveSettings(config.settingsLayer()), map[string]interface{}{}),
+	}, nil
+}
+
+func (b *wireguardBackend) pathConfigWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.configLock.Lock()
+	defer b.configLock.Unlock()
+
+	config, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	previous := resolveSettings(config.settingsLayer())
+
+	if dns, ok := data.GetOk("dns"); ok {
+		config.DNS = dns.([]string)
+	}
+
+	if keyPolicy, ok := data.GetOk("key_policy"); ok {
+		if err := validateKeyPolicy(keyPolicy.(string)); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+
+		config.KeyPolicy = keyPolicy.(string)
+	}
+
+	if maxTTL, ok := data.GetOk("max_ttl"); ok {
+		config.MaxTTL = maxTTL.(int)
+	}
+
+	if materializeInterval, ok := data.GetOk("materialize_interval"); ok {
+		config.MaterializeInterval = materializeInterval.(int)
+	}
+
+	if mtu, ok := data.GetOk("mtu"); ok {
+		config.MTU = mtu.(int)
+	}
+
+	if persistentKeepalive, ok := data.GetOk("persistent_keepalive"); ok {
+		config.PersistentKeepalive = persistentKeepalive.(int)
+	}
+
+	if port, ok := data.GetOk("port"); ok {
+		config.Port = port.(int)
+	}
+
+	if presharedKeys, ok := data.GetOk("preshared_keys"); ok {
+		if err := validatePresharedKeys(presharedKeys.(string)); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+
+		config.PresharedKeys = presharedKeys.(string)
+	}
+
+	if privateKeyFile, ok := data.GetOk("private_key_file"); ok {
+		config.PrivateKeyFile = privateKeyFile.(string)
+	}
+
+	if rotationPeriod, ok := data.GetOk("rotation_period"); ok {
+		config.RotationPeriod = rotationPeriod.(int)
+	}
+
+	if ttl, ok := data.GetOk("ttl"); ok {
+		config.TTL = ttl.(int)
+	}
+
+	overrides, err := config.settingsLayer().updateOverrides(data)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	config.Overrides = overrides
+
+	if err := b.put(ctx, req.Storage, "config", config); err != nil {
+		return nil, err
+	}
+
+	settings := resolveSettings(config.settingsLayer())
+	changed := []string{}
+
+	if settings.string("preshared_keys") != previous.string("preshared_keys") {
+		changed = append(changed, "preshared_keys")
+	}
+
+	if settings.string("key_policy") == keyPolicyClient && previous.string("key_policy") != keyPolicyClient {
+		changed = append(changed, "key_policy")
+	}
+
+	if len(changed) > 0 {
+		return b.rebuildInheritingGroups(ctx, req.Storage, changed...)
+	}
+
+	return nil, nil
+}
+
+// rebuildInheritingGroups rebuilds the groups that inherit any of the settings from the config, so their preshared keys are generated or removed, and the private keys of peers with key_policy client are removed.  The config lock must be held.
+func (b *wireguardBackend) rebuildInheritingGroups(ctx context.Context, s logical.Storage, keys ...string) (*logical.Response, error) {
+	groupNames, err := listGroups(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, groupName := range groupNames {
+		group, err := b.getGroup(ctx, s, groupName)
+		if err != nil {
+			return nil, err
+		}
+
+		if group == nil || !group.settingsLayer().inheritsAny(keys...) {
+			continue
+		}
+
+		res, err := withWAL(ctx, s, walKindGroupRebuild, &groupWAL{
+			Group: groupName,
+		}, func() (*logical.Response, error) {
+			return b.rollbackGroupRebuild(ctx, s, groupName)
+		})
+		if err != nil || res != nil && res.IsError() {
+			return res, err
+		}
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	// Defaults
+	req := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "config",
+		Storage:   s,
+	}
+
+	res, err := b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Equal(t, 60, res.Data["ttl"])
+	require.Equal(t, "default", res.Data["sources"].(map[string]string)["ttl"])
+
+	// Write
+	req = &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"key_policy": "random",
+		},
+	}
+
+	res, err = b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Equal(t, "unknown key_policy: random", res.Error().Error())
+
+	req.Data = map[string]interface{}{
+		"dns":                  "10.0.0.1",
+		"max_ttl":              "1h",
+		"mtu":                  1380,
+		"persistent_keepalive": 25,
+		"ttl":                  "5m",
+	}
+
+	res, err = b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	// Read
+	req = &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "config",
+		Storage:   s,
+	}
+
+	res, err = b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Equal(t, map[string]interface{}{
+		"dns":                  []string{"10.0.0.1"},
+		"key_policy":           "generate",
+		"materialize_interval": 0,
+		"max_ttl":              3600,
+		"mtu":                  1380,
+		"persistent_keepalive": 25,
+		"port":                 0,
+		"preshared_keys":       "none",
+		"private_key_file":     "",
+		"rotation_period":      0,
+		"sources": map[string]string{
+			"dns":                  "config",
+			"key_policy":           "default",
+			"materialize_interval": "default",
+			"max_ttl":              "config",
+			"mtu":                  "config",
+			"persistent_keepalive": "config",
+			"port":                 "default",
+			"preshared_keys":       "default",
+			"private_key_file":     "default",
+			"rotation_period":      "default",
+			"ttl":                  "config",
+		},
+		"ttl": 300,
+	}, res.Data)
+
+	// Inherit
+	req = &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/mygroup",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"key_policy": "provided",
+			"mtu":        1280,
+			"network":    "10.0.0.0/24",
+			"port":       51820,
+		},
+	}
+
+	res, err = b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	req = &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/mygroup/peer1",
+		Storage:   s,
+	}
+
+	res, err = b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Equal(t, "key_policy requires a private_key or public_key to be provided", res.Error().Error())
+
+	req.Data = map[string]interface{}{
+		"dns":         "10.0.0.2,10.0.0.3",
+		"private_key": privateKey,
+	}
+
+	res, err = b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	req = &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/mygroup/peer2",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"persistent_keepalive": 10,
+			"public_key":           publicKey,
+		},
+	}
+
+	res, err = b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	req = &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "groups/mygroup/peer1",
+		Storage:   s,
+	}
+
+	res, err = b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Equal(t, []string{"10.0.0.2", "10.0.0.3"}, res.Data["dns"])
+	require.Equal(t, 1280, res.Data["mtu"])
+	require.Equal(t, 51820, res.Data["port"])
+	require.Equal(t, map[string]string{
+		"dns":                  "peer",
+		"mtu":                  "group",
+		"key_policy":           "group",
+		"persistent_keepalive": "config",
+		"private_key_file":     "default",
+		"rotation_period":      "default",
+		"port":                 "group",
+	}, res.Data["sources"])
+
+	req = &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "groups/mygroup/peer1/wg-quick",
+		Storage:   s,
+	}
+
+	res, err = b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Equal(t, 300, res.Data["ttl"])
+	require.Equal(t, 3600, res.Data["max_ttl"])
+	require.Equal(t, fmt.Sprintf(`# mygroup/peer1
+
+[Interface]
+Address=10.0.0.1/24
+PrivateKey=%s
+ListenPort=51820
+MTU=1280
+DNS=10.0.0.2,10.0.0.3
+
+# peer2
+[Peer]
+PublicKey=%s
+AllowedIPs=10.0.0.2/32
+Endpoint=peer2:51820
+`, privateKey, publicKey), res.Data["config"])
+
+	// Zero values override inherited ones too
+	write := func(path string, data map[string]interface{}) *logical.Response {
+		res, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Storage:   s,
+			Data:      data,
+		})
+		require.Nil(t, err)
+
+		return res
+	}
+
+	readPeer := func() *logical.Response {
+		res, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "groups/mygroup/peer1",
+			Storage:   s,
+		})
+		require.Nil(t, err)
+
+		return res
+	}
+
+	require.Nil(t, write("groups/mygroup", map[string]interface{}{
+		"key_policy": "",
+		"mtu":        0,
+	}))
+	require.Nil(t, write("groups/mygroup/peer1", map[string]interface{}{
+		"dns":                  "",
+		"persistent_keepalive": 0,
+	}))
+
+	res = readPeer()
+	require.Equal(t, []string{}, res.Data["dns"])
+	require.Equal(t, 0, res.Data["mtu"])
+	require.Equal(t, 0, res.Data["persistent_keepalive"])
+	require.Equal(t, "generate", res.Data["key_policy"])
+	require.Equal(t, "peer", res.Data["sources"].(map[string]string)["dns"])
+	require.Equal(t, "group", res.Data["sources"].(map[string]string)["mtu"])
+	require.Equal(t, "peer", res.Data["sources"].(map[string]string)["persistent_keepalive"])
+	require.Equal(t, "default", res.Data["sources"].(map[string]string)["key_policy"])
+
+	// Until they are unset
+	require.Nil(t, write("groups/mygroup/peer1", map[string]interface{}{
+		"inherit": "dns,persistent_keepalive",
+	}))
+
+	res = readPeer()
+	require.Equal(t, []string{"10.0.0.1"}, res.Data["dns"])
+	require.Equal(t, 25, res.Data["persistent_keepalive"])
+	require.Equal(t, "config", res.Data["sources"].(map[string]string)["dns"])
+
+	require.Equal(t, "unknown setting in inherit: materialize_interval", write("groups/mygroup/peer1", map[string]interface{}{
+		"inherit": "materialize_interval",
+	}).Error().Error())
+
+	// A zero ttl is returned as is, instead of the default
+	readTTL := func() (interface{}, interface{}) {
+		res, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "groups/mygroup/peer1/wg-quick",
+			Storage:   s,
+		})
+		require.Nil(t, err)
+
+		return res.Data["ttl"], res.Data["max_ttl"]
+	}
+
+	require.Nil(t, write("groups/mygroup", map[string]interface{}{
+		"max_ttl": 0,
+		"ttl":     0,
+	}))
+
+	ttl, maxTTL := readTTL()
+	require.Equal(t, 0, ttl)
+	require.Equal(t, 0, maxTTL)
+
+	require.Nil(t, write("groups/mygroup", map[string]interface{}{
+		"inherit": "max_ttl,ttl",
+	}))
+
+	ttl, maxTTL = readTTL()
+	require.Equal(t, 300, ttl)
+	require.Equal(t, 3600, maxTTL)
+
+	require.Nil(t, write("config", map[string]interface{}{
+		"inherit": "max_ttl,ttl",
+	}))
+
+	ttl, maxTTL = readTTL()
+	require.Equal(t, 60, ttl)
+	require.Equal(t, 60, maxTTL)
+}
@@ -4,8 +4,8 @@ import (
 	"context"
 	"fmt"
 	"net/netip"
+	"reflect"
 	"strings"
-	"time"
 
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
@@ -13,26 +13,132 @@ import (
 )
 
 type wireguardGroup struct {
-	Name                string               `json:"name" mapstructure:"name"`
-	Network             netip.Prefix         `json:"network" mapstructure:"network"`
-	Peers               []wireguardGroupPeer `json:"peers" mapstructure:"peers"`
-	PersistentKeepalive int                  `json:"persistent_keepalive" mapstructure:"persistent_keepalive"`
-	TTL                 int                  `json:"ttl" mapstructure:"ttl"`
-	MaxTTL              int                  `json:"max_ttl" mapstructure:"max_ttl"`
+	AccessRules            []accessRule         `json:"access_rules" mapstructure:"access_rules"`
+	DefaultAccess          string               `json:"default_access" mapstructure:"default_access"`
+	DNS                    []string             `json:"dns" mapstructure:"dns"`
+	DelegationNetwork      netip.Prefix         `json:"delegation_network" mapstructure:"delegation_network"`
+	DelegationPrefixLength int                  `json:"delegation_prefix_length" mapstructure:"delegation_prefix_length"`
+	IPAMMode               string               `json:"ipam_mode" mapstructure:"ipam_mode"`
+	KeyPolicy              string               `json:"key_policy" mapstructure:"key_policy"`
+	MaterializeInterval    int                  `json:"materialize_interval" mapstructure:"materialize_interval"`
+	MTU                    int                  `json:"mtu" mapstructure:"mtu"`
+	Name                   string               `json:"name" mapstructure:"name"`
+	Networks               []netip.Prefix       `json:"networks" mapstructure:"networks"`
+	Overrides              []string             `json:"overrides" mapstructure:"-"`
+	Peers                  []wireguardGroupPeer `json:"peers,omitempty" mapstructure:"peers"`
+	PreviousNetworks       []netip.Prefix       `json:"previous_networks" mapstructure:"previous_networks"`
+	PersistentKeepalive    int                  `json:"persistent_keepalive" mapstructure:"persistent_keepalive"`
+	Port                   int                  `json:"port" mapstructure:"port"`
+	PresharedKeys          string               `json:"preshared_keys" mapstructure:"preshared_keys"`
+	PrivateKeyFile         string               `json:"private_key_file" mapstructure:"private_key_file"`
+	RotationPeriod         int                  `json:"rotation_period" mapstructure:"rotation_period"`
+	ReservedRanges         []netip.Prefix       `json:"reserved_ranges" mapstructure:"reserved_ranges"`
+	Topology               string               `json:"topology" mapstructure:"topology"`
+	TTL                    int                  `json:"ttl" mapstructure:"ttl"`
+	MaxTTL                 int                  `json:"max_ttl" mapstructure:"max_ttl"`
+
+	// PeerRoutes are the routes of the peers that have any, keyed by peer name, so the address space can be checked without reading every group directory.
+	PeerRoutes map[string][]netip.Prefix `json:"peer_routes" mapstructure:"-"`
+
+	// embeddedDirectory is set for groups that still store their directory in the group entry, from before it was split into buckets.
+	embeddedDirectory bool
 }
 
+// wireguardGroupPeer is the public directory entry of a peer, used to render the [Peer] sections of the other peers.  Secrets are only stored in the peer entries.
 type wireguardGroupPeer struct {
-	AllowedIPs          string `json:"allowed_ips"`
-	Hostname            string `json:"hostname"`
-	IP                  string `json:"ip"`
-	Name                string `json:"name"`
-	PersistentKeepalive int    `json:"persistent_keepalive"`
-	Port                int    `json:"port"`
-	PrivateKey          string `json:"private_key"`
-	PublicKey           string `json:"public_key"`
+	AllowedIPs      string       `json:"allowed_ips"`
+	DelegatedPrefix netip.Prefix `json:"delegated_prefix"`
+	// Endpoint is the endpoint of the peer used by the peer the config is rendered for.
+	Endpoint            string              `json:"-"`
+	Endpoints           []wireguardEndpoint `json:"endpoints"`
+	ExitNode            bool                `json:"exit_node"`
+	Hostname            string              `json:"hostname"`
+	Hub                 bool                `json:"hub"`
+	IP                  string              `json:"ip"`
+	Labels              []string            `json:"labels"`
+	Name                string              `json:"name"`
+	Overrides           []string            `json:"overrides"`
+	PersistentKeepalive int                 `json:"persistent_keepalive"`
+	Port                int                 `json:"port"`
+	PresharedKey        string              `json:"-"`
+	PublicKey           string              `json:"public_key"`
+	Relay               bool                `json:"relay"`
+	RotationPeriod      int                 `json:"rotation_period"`
+	Site                string              `json:"site"`
+}
+
+func (g *wireguardGroup) settingsLayer() settingsLayer {
+	return settingsLayer{
+		Overrides: g.Overrides,
+		Source:    settingsSourceGroup,
+		Values: map[string]interface{}{
+			"dns":                  g.DNS,
+			"key_policy":           g.KeyPolicy,
+			"materialize_interval": g.MaterializeInterval,
+			"max_ttl":              g.MaxTTL,
+			"mtu":                  g.MTU,
+			"persistent_keepalive": g.PersistentKeepalive,
+			"port":                 g.Port,
+			"preshared_keys":       g.PresharedKeys,
+			"private_key_file":     g.PrivateKeyFile,
+			"rotation_period":      g.RotationPeriod,
+			"ttl":                  g.TTL,
+		},
+	}
+}
+
+func (p *wireguardGroupPeer) settingsLayer() settingsLayer {
+	return settingsLayer{
+		Overrides: p.Overrides,
+		Source:    settingsSourcePeer,
+		Values: map[string]interface{}{
+			"persistent_keepalive": p.PersistentKeepalive,
+			"port":                 p.Port,
+			"rotation_period":      p.RotationPeriod,
+		},
+	}
+}
+
+// listGroups returns the names of the groups, without the peer folders.
+func listGroups(ctx context.Context, s logical.Storage) ([]string, error) {
+	entries, err := s.List(ctx, "groups/")
+	if err != nil {
+		return nil, fmt.Errorf("error listing groups: %w", err)
+	}
+
+	names := []string{}
+
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry, "/") {
+			names = append(names, entry)
+		}
+	}
+
+	return names, nil
 }
 
 func getGroup(ctx context.Context, s logical.Storage, name string) (*wireguardGroup, error) {
+	group, err := getGroupEntry(ctx, s, name)
+	if err != nil || group == nil {
+		return group, err
+	}
+
+	if len(group.Peers) > 0 {
+		group.embeddedDirectory = true
+	} else if group.Peers, err = getDirectory(ctx, s, name); err != nil {
+		return nil, err
+	}
+
+	// Groups written before the route index
+	if group.PeerRoutes == nil {
+		group.indexPeerRoutes()
+	}
+
+	return group, nil
+}
+
+// getGroupEntry returns the group without reading its directory.  Peers are only set for groups that still embed their directory.
+func getGroupEntry(ctx context.Context, s logical.Storage, name string) (*wireguardGroup, error) {
 	if name == "" {
 		return nil, fmt.Errorf("missing group name")
 	}
@@ -52,59 +158,337 @@ func getGroup(ctx context.Context, s logical.Storage, name string) (*wireguardGr
 		return nil, fmt.Errorf("error decoding group data: %w", err)
 	}
 
+	// Groups used to have a single network
+	if len(group.Networks) == 0 {
+		var legacy struct {
+			Network netip.Prefix `json:"network"`
+		}
+
+		if err := entry.DecodeJSON(&legacy); err != nil {
+			return nil, fmt.Errorf("error decoding group data: %w", err)
+		}
+
+		if legacy.Network.IsValid() {
+			group.Networks = []netip.Prefix{legacy.Network}
+		}
+	}
+
 	return &group, nil
 }
 
-func (b *wireguardBackend) updateGroupPeers(ctx context.Context, s logical.Storage, name string) (*logical.Response, error) {
-	group, err := getGroup(ctx, s, name)
+// peerRoutes returns the additional allowed_ips of a peer, leaving out its own addresses and delegated prefix.
+func peerRoutes(peer wireguardGroupPeer) []netip.Prefix {
+	own := map[string]bool{
+		peer.DelegatedPrefix.String(): true,
+	}
+
+	for _, address := range strings.Split(peer.IP, ",") {
+		if prefix, err := netip.ParsePrefix(address); err == nil {
+			own[hostPrefix(prefix.Addr()).String()] = true
+		}
+	}
+
+	routes := []netip.Prefix{}
+
+	for _, allowedIP := range strings.Split(peer.AllowedIPs, ",") {
+		if prefix, err := netip.ParsePrefix(allowedIP); err == nil && !own[allowedIP] {
+			routes = append(routes, prefix)
+		}
+	}
+
+	return routes
+}
+
+// indexPeerRoutes rebuilds the route index from the whole directory.
+func (g *wireguardGroup) indexPeerRoutes() {
+	g.PeerRoutes = map[string][]netip.Prefix{}
+
+	for _, peer := range g.Peers {
+		if routes := peerRoutes(peer); len(routes) > 0 {
+			g.PeerRoutes[peer.Name] = routes
+		}
+	}
+}
+
+// updatePeerRoutes updates the route index entries of the named peers from their directory entries.  Returns whether it changed.
+func (g *wireguardGroup) updatePeerRoutes(names ...string) bool {
+	changed := false
+
+	for _, name := range names {
+		peer, ok := directoryPeer(g, name)
+		routes := peerRoutes(peer)
+
+		if !ok || len(routes) == 0 {
+			if _, ok := g.PeerRoutes[name]; ok {
+				delete(g.PeerRoutes, name)
+				changed = true
+			}
+
+			continue
+		}
+
+		if !reflect.DeepEqual(g.PeerRoutes[name], routes) {
+			g.PeerRoutes[name] = routes
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// ipamKey returns the key a peer's addresses are derived from, if the group derives addresses from keys.
+func (g *wireguardGroup) ipamKey(peer *wireguardPeer) string {
+	if g.IPAMMode == ipamModeKey {
+		return peer.PublicKey
+	}
+
+	return ""
+}
+
+// groupIPs returns the peer addresses currently rendered for the group, keyed by peer name.
+func groupIPs(group *wireguardGroup) map[string][]netip.Addr {
+	ips := map[string][]netip.Addr{}
+
+	for _, peer := range group.Peers {
+		for _, address := range strings.Split(peer.IP, ",") {
+			if prefix, err := netip.ParsePrefix(address); err == nil {
+				ips[peer.Name] = append(ips[peer.Name], prefix.Addr())
+			}
+		}
+	}
+
+	return ips
+}
+
+// groupDelegatedPrefixes returns the delegated prefixes of the group peers, except for the named peer.
+func groupDelegatedPrefixes(group *wireguardGroup, except string) prefixSet {
+	used := prefixSet{}
+
+	for _, peer := range group.Peers {
+		if peer.Name != except && peer.DelegatedPrefix.IsValid() {
+			used.add(peer.DelegatedPrefix)
+		}
+	}
+
+	return used
+}
+
+// delegatePrefix sets or clears the delegated prefix for a peer depending on the group delegation settings.
+func delegatePrefix(group *wireguardGroup, peer *wireguardPeer, used prefixSet) error {
+	if !group.DelegationNetwork.IsValid() {
+		peer.DelegatedPrefix = netip.Prefix{}
+
+		return nil
+	}
+
+	if isDelegatedPrefix(group.DelegationNetwork, group.DelegationPrefixLength, peer.DelegatedPrefix) {
+		return nil
+	}
+
+	prefix, err := allocatePrefix(group.DelegationNetwork, group.DelegationPrefixLength, used)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	peerNames, err := s.List(ctx, "groups/"+name+"/")
+	peer.DelegatedPrefix = prefix
+
+	return nil
+}
+
+// updateGroupPeers rebuilds the group peer list from the stored peers and saves the group.  Peers without a valid address in each group network are allocated one, preferring the addresses they were previously rendered with.  Delegated prefixes are allocated the same way.  Missing preshared keys are generated, and pairs for which rotatePSK returns true get a new one.  Stored private keys of peers with key_policy client are removed.  The group lock must be held.
+func (b *wireguardBackend) updateGroupPeers(ctx context.Context, s logical.Storage, group *wireguardGroup, rotatePSK func(a, b string) bool) (*logical.Response, error) {
+	peerNames, err := s.List(ctx, "groups/"+group.Name+"/")
 	if err != nil {
 		return logical.ErrorResponse("no peers in group"), err
 	}
 
-	ip := group.Network.Addr()
-	group.Peers = make([]wireguardGroupPeer, len(peerNames))
+	config, err := getConfig(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	presharedKeys := resolveSettings(config.settingsLayer(), group.settingsLayer()).string("preshared_keys")
+	if err := b.updateGroupPSK(ctx, s, group.Name, presharedKeys, false); err != nil {
+		return nil, err
+	}
+
+	previous := groupIPs(group)
+	peers := make([]*wireguardPeer, len(peerNames))
+	removedKeys := make([]bool, len(peerNames))
+	stored := make([][]netip.Addr, len(peerNames))
+	storedPrevious := make([][]netip.Addr, len(peerNames))
+	storedPrefixes := make([]netip.Prefix, len(peerNames))
+	used := ipSet{}
+	usedPrefixes := prefixSet{}
 
 	for i := range peerNames {
-		ip = ip.Next()
-		addr := fmt.Sprintf("%s/%d", ip, group.Network.Bits())
-		allow := ip.String()
+		p, err := getPeer(ctx, s, group.Name, peerNames[i])
+		if err != nil {
+			return nil, err
+		}
+
+		peers[i] = p
+		stored[i] = p.IPs
+		storedPrevious[i] = p.PreviousIPs
+		storedPrefixes[i] = p.DelegatedPrefix
 
-		if ip.Is4() {
-			allow += "/32"
+		// Keys stored before the peer held its own key are dropped
+		if p.PrivateKey != "" && resolveSettings(config.settingsLayer(), group.settingsLayer(), p.settingsLayer()).string("key_policy") == keyPolicyClient {
+			p.PrivateKey = ""
+			removedKeys[i] = true
+		}
+
+		// Addresses from before a renumber are kept during the transition
+		previousIPs := []netip.Addr{}
+
+		for _, network := range group.PreviousNetworks {
+			if ip := addrIn(network, p.PreviousIPs); ip.IsValid() {
+				previousIPs = append(previousIPs, ip)
+				used.add(ip)
+			}
+		}
+
+		p.PreviousIPs = previousIPs
+
+		if isDelegatedPrefix(group.DelegationNetwork, group.DelegationPrefixLength, p.DelegatedPrefix) && !usedPrefixes.has(p.DelegatedPrefix) {
+			usedPrefixes.add(p.DelegatedPrefix)
 		} else {
-			allow += "/128"
+			p.DelegatedPrefix = netip.Prefix{}
+		}
+
+		if len(p.IPs) == 0 {
+			p.IPs = previous[p.Name]
 		}
 
-		p, err := getPeer(ctx, s, name, peerNames[i])
+		ips := []netip.Addr{}
+
+		for _, network := range group.Networks {
+			if ip := addrIn(network, p.IPs); ip.IsValid() && !used.has(ip) {
+				ips = append(ips, ip)
+				used.add(ip)
+			}
+		}
+
+		p.IPs = ips
+	}
+
+	for _, p := range peers {
+		p.IPs, err = allocateIPs(group.Networks, p.IPs, used, group.ReservedRanges, group.ipamKey(p))
 		if err != nil {
-			return nil, err
+			return logical.ErrorResponse(fmt.Sprintf("error allocating address for peer %s: %s", p.Name, err)), nil
 		}
 
-		peer := wireguardGroupPeer{
-			AllowedIPs: strings.Join(append([]string{allow}, p.AllowedIPs...), ","),
-			IP:         addr,
-			Hostname:   p.Hostname,
-			Name:       p.Name,
-			Port:       p.Port,
-			PrivateKey: p.PrivateKey,
-			PublicKey:  p.PublicKey,
+		if err := delegatePrefix(group, p, usedPrefixes); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("error delegating prefix for peer %s: %s", p.Name, err)), nil
 		}
+	}
 
-		if peer.Port == 0 {
-			peer.PersistentKeepalive = group.PersistentKeepalive
+	changed, err := updatePairPSKs(peers, presharedKeys == presharedKeysPair, rotatePSK)
+	if err != nil {
+		return nil, err
+	}
+
+	group.Peers = make([]wireguardGroupPeer, len(peers))
+
+	for i, p := range peers {
+		if changed[i] || removedKeys[i] || !equalAddrs(p.IPs, stored[i]) || !equalAddrs(p.PreviousIPs, storedPrevious[i]) || p.DelegatedPrefix != storedPrefixes[i] {
+			if err := b.putPeer(ctx, s, group.Name, p.Name, p); err != nil {
+				return nil, err
+			}
 		}
 
-		group.Peers[i] = peer
+		group.Peers[i] = groupPeer(group, p)
 	}
 
-	err = b.put(ctx, s, "groups/"+name, group)
+	if err := b.putGroup(ctx, s, group); err != nil {
+		return nil, err
+	}
 
-	return nil, err
+	return nil, b.clearPending(ctx, s, group.Name)
+}
+
+// updateGroupPeer replaces the directory entry of a single peer, or removes it if peer is nil, and saves the group without reading the other peers.  If the group materializes asynchronously, the change is marked as pending instead.  Groups using pair preshared keys are rebuilt when a peer is added or removed, as the other peers share a key with it.  The group lock must be held.
+func (b *wireguardBackend) updateGroupPeer(ctx context.Context, s logical.Storage, group *wireguardGroup, name string, peer *wireguardPeer) (*logical.Response, error) {
+	config, err := getConfig(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := resolveSettings(config.settingsLayer(), group.settingsLayer())
+	if settings.int("materialize_interval") > 0 {
+		return nil, b.markPending(ctx, s, group.Name, name)
+	}
+
+	presharedKeys := settings.string("preshared_keys")
+	if applyGroupPeer(group, name, peer) && presharedKeys == presharedKeysPair {
+		return b.updateGroupPeers(ctx, s, group, nil)
+	}
+
+	if err := b.updateGroupPSK(ctx, s, group.Name, presharedKeys, false); err != nil {
+		return nil, err
+	}
+
+	return nil, b.putGroup(ctx, s, group, name)
+}
+
+// directoryOverrides returns the overrides of the settings stored in the directory entry of a peer.
+func directoryOverrides(overrides []string) []string {
+	if overrides == nil {
+		return nil
+	}
+
+	directory := []string{}
+
+	for _, key := range overrides {
+		if key == "persistent_keepalive" || key == "port" || key == "rotation_period" {
+			directory = append(directory, key)
+		}
+	}
+
+	return directory
+}
+
+// groupPeer returns the directory entry for a peer.
+func groupPeer(group *wireguardGroup, p *wireguardPeer) wireguardGroupPeer {
+	addresses := []string{}
+	allowedIPs := []string{}
+
+	for i, ip := range p.IPs {
+		addresses = append(addresses, netip.PrefixFrom(ip, group.Networks[i].Bits()).String())
+		allowedIPs = append(allowedIPs, hostPrefix(ip).String())
+	}
+
+	for _, ip := range p.PreviousIPs {
+		for _, network := range group.PreviousNetworks {
+			if network.Contains(ip) {
+				addresses = append(addresses, netip.PrefixFrom(ip, network.Bits()).String())
+				allowedIPs = append(allowedIPs, hostPrefix(ip).String())
+			}
+		}
+	}
+
+	if p.DelegatedPrefix.IsValid() {
+		allowedIPs = append(allowedIPs, p.DelegatedPrefix.String())
+	}
+
+	return wireguardGroupPeer{
+		AllowedIPs:          strings.Join(append(allowedIPs, p.AllowedIPs...), ","),
+		DelegatedPrefix:     p.DelegatedPrefix,
+		Endpoints:           p.Endpoints,
+		ExitNode:            p.ExitNode,
+		IP:                  strings.Join(addresses, ","),
+		Labels:              p.Labels,
+		Hostname:            p.Hostname,
+		Hub:                 p.Hub,
+		Name:                p.Name,
+		Overrides:           directoryOverrides(p.Overrides),
+		PersistentKeepalive: p.PersistentKeepalive,
+		Port:                p.Port,
+		PublicKey:           p.PublicKey,
+		Relay:               p.Relay,
+		RotationPeriod:      p.RotationPeriod,
+		Site:                p.Site,
+	}
 }
 
 func (b *wireguardBackend) pathGroupsList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
@@ -119,29 +503,57 @@ func (b *wireguardBackend) pathGroupsList(ctx context.Context, req *logical.Requ
 func (b *wireguardBackend) pathGroupsDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
 	groupname := data.Get("name").(string)
 
-	b.lock.Lock()
-	defer b.lock.Unlock()
+	lock := b.groupLock(groupname)
+	lock.Lock()
+	defer lock.Unlock()
 
-	if err := req.Storage.Delete(ctx, "groups/"+groupname); err != nil {
-		return nil, err
+	return withWAL(ctx, req.Storage, walKindGroupDelete, &groupWAL{
+		Group: groupname,
+	}, func() (*logical.Response, error) {
+		if err := b.delete(ctx, req.Storage, "groups/"+groupname); err != nil {
+			return nil, err
+		}
+
+		return nil, b.deleteGroupEntries(ctx, req.Storage, groupname)
+	})
+}
+
+// deleteGroupEntries deletes the directory, peers, preshared keys and pending changes of a group.  The group lock must be held.
+func (b *wireguardBackend) deleteGroupEntries(ctx context.Context, s logical.Storage, name string) error {
+	if err := b.deleteDirectory(ctx, s, name); err != nil {
+		return err
 	}
 
-	peerNames, err := req.Storage.List(ctx, "groups/"+groupname+"/")
+	if err := b.delete(ctx, s, "psk/"+name); err != nil {
+		return err
+	}
+
+	if err := b.clearPending(ctx, s, name); err != nil {
+		return err
+	}
+
+	peerNames, err := s.List(ctx, "groups/"+name+"/")
 	if err != nil {
-		return logical.ErrorResponse("no peers in group"), err
+		return fmt.Errorf("error listing peers: %w", err)
 	}
 
 	for i := range peerNames {
-		if err := req.Storage.Delete(ctx, "groups/"+groupname+"/"+peerNames[i]); err != nil {
-			return nil, err
+		if err := b.deletePeer(ctx, s, name, peerNames[i]); err != nil {
+			return err
 		}
 	}
 
-	return nil, nil
+	return nil
 }
 
 func (b *wireguardBackend) pathGroupsRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-	group, err := getGroup(ctx, req.Storage, data.Get("name").(string))
+	name := data.Get("name").(string)
+
+	lock := b.groupLock(name)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	group, err := b.getGroup(ctx, req.Storage, name)
 	if err != nil {
 		return nil, err
 	}
@@ -150,6 +562,11 @@ func (b *wireguardBackend) pathGroupsRead(ctx context.Context, req *logical.Requ
 		return nil, nil
 	}
 
+	config, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
 	var groupMap map[string]interface{}
 
 	err = mapstructure.Decode(group, &groupMap)
@@ -157,8 +574,48 @@ func (b *wireguardBackend) pathGroupsRead(ctx context.Context, req *logical.Requ
 		return nil, err
 	}
 
+	settingsResponse(resolveSettings(config.settingsLayer(), group.settingsLayer()), groupMap)
+	delete(groupMap, "networks")
 	delete(groupMap, "peers")
-	groupMap["network"] = group.Network.String()
+	delete(groupMap, "previous_networks")
+	groupMap["delegation_network"] = ""
+	groupMap["network"] = joinPrefixes(group.Networks)
+	groupMap["previous_network"] = joinPrefixes(group.PreviousNetworks)
+
+	if group.IPAMMode == "" {
+		groupMap["ipam_mode"] = ipamModeSequential
+	}
+
+	if group.Topology == "" {
+		groupMap["topology"] = topologyFullMesh
+	}
+
+	if group.DefaultAccess == "" {
+		groupMap["default_access"] = accessAllow
+	}
+
+	rules := make([]string, len(group.AccessRules))
+	for i := range group.AccessRules {
+		rules[i] = group.AccessRules[i].String()
+	}
+
+	groupMap["access_rules"] = rules
+
+	if group.DelegationNetwork.IsValid() {
+		groupMap["delegation_network"] = group.DelegationNetwork.String()
+	}
+
+	reserved := make([]string, len(group.ReservedRanges))
+	for i := range group.ReservedRanges {
+		reserved[i] = group.ReservedRanges[i].String()
+	}
+
+	groupMap["reserved_ranges"] = reserved
+
+	groupMap["state"], err = groupState(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
 
 	return &logical.Response{
 		Data: groupMap,
@@ -171,48 +628,236 @@ func (b *wireguardBackend) pathGroupsWrite(ctx context.Context, req *logical.Req
 		return logical.ErrorResponse("missing group name"), nil
 	}
 
-	group, err := getGroup(ctx, req.Storage, name)
+	b.configLock.Lock()
+	defer b.configLock.Unlock()
+
+	lock := b.groupLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	group, err := b.getGroup(ctx, req.Storage, name)
 	if err != nil {
 		return nil, err
 	}
 
 	if group == nil {
+		// Peers of a group that is being deleted would be adopted by the new group
+		peerNames, err := req.Storage.List(ctx, "groups/"+name+"/")
+		if err != nil {
+			return nil, fmt.Errorf("error listing peers: %w", err)
+		}
+
+		if len(peerNames) > 0 {
+			return logical.ErrorResponse(fmt.Sprintf("group %s is still being deleted", name)), nil
+		}
+
 		group = &wireguardGroup{}
 	}
 
 	group.Name = name
 	create := (req.Operation == logical.CreateOperation)
 
+	networks, routes, err := addressSpaceUsage(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	taken := networks
+
+	// Peers can route prefixes of their own group network
+	for _, route := range routes {
+		if !strings.HasPrefix(route.Peer, name+"/") || !prefixWithin(route.Prefix, group.Networks) {
+			taken = append(taken, route)
+		}
+	}
+
 	if network, ok := data.GetOk("network"); ok {
-		prefix, err := netip.ParsePrefix(network.(string))
+		values, err := b.parseGroupNetworks(ctx, req.Storage, network.([]string), group.Networks, taken, true)
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("error allocating network: %s", err)), nil
+		}
+
+		networks, err := parseNetworks(values)
 		if err != nil {
-			return logical.ErrorResponse(fmt.Sprintf("error parsing network: %e", err)), nil
+			return logical.ErrorResponse(fmt.Sprintf("error parsing network: %s", err)), nil
 		}
 
-		group.Network = prefix
+		for _, network := range networks {
+			if overlap := findOverlap(network, taken); overlap != nil {
+				return logical.ErrorResponse(fmt.Sprintf("network %s overlaps %s", network, overlap.Owner)), nil
+			}
+		}
+
+		group.Networks = networks
 	} else if create {
 		return logical.ErrorResponse("missing network field"), nil
 	}
 
-	if ttl, ok := data.GetOk("ttl"); ok && ttl.(int) != 0 {
-		group.TTL = int((time.Duration(ttl.(int)) * time.Second).Seconds())
-	} else {
-		group.TTL = int(time.Duration(60 * time.Second).Seconds())
+	if ipamMode, ok := data.GetOk("ipam_mode"); ok {
+		switch ipamMode.(string) {
+		case ipamModeKey:
+		case ipamModeSequential:
+		default:
+			return logical.ErrorResponse(fmt.Sprintf("unknown ipam_mode: %s", ipamMode)), nil
+		}
+
+		group.IPAMMode = ipamMode.(string)
+	}
+
+	if reservedRanges, ok := data.GetOk("reserved_ranges"); ok {
+		prefixes, err := parsePrefixes(reservedRanges.([]string))
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("error parsing reserved_ranges: %s", err)), nil
+		}
+
+		for _, prefix := range prefixes {
+			within := false
+
+			for _, network := range group.Networks {
+				within = within || network.Overlaps(prefix)
+			}
+
+			if !within {
+				return logical.ErrorResponse(fmt.Sprintf("reserved range %s is not within network %s", prefix, joinPrefixes(group.Networks))), nil
+			}
+		}
+
+		group.ReservedRanges = prefixes
+	}
+
+	if delegationNetwork, ok := data.GetOk("delegation_network"); ok {
+		group.DelegationNetwork = netip.Prefix{}
+
+		if delegationNetwork != "" {
+			prefix, err := netip.ParsePrefix(delegationNetwork.(string))
+			if err != nil {
+				return logical.ErrorResponse(fmt.Sprintf("error parsing delegation_network: %s", err)), nil
+			}
+
+			if overlap := findOverlap(prefix, taken); overlap != nil {
+				return logical.ErrorResponse(fmt.Sprintf("delegation_network %s overlaps %s", prefix, overlap.Owner)), nil
+			}
+
+			group.DelegationNetwork = prefix.Masked()
+		}
 	}
 
-	if maxTTL, ok := data.GetOk("ttl"); ok && maxTTL.(int) != 0 {
-		group.MaxTTL = int((time.Duration(maxTTL.(int)) * time.Second).Seconds())
-	} else {
-		group.MaxTTL = int(time.Duration(60 * time.Second).Seconds())
+	if delegationPrefixLength, ok := data.GetOk("delegation_prefix_length"); ok {
+		group.DelegationPrefixLength = delegationPrefixLength.(int)
+	}
+
+	if group.DelegationNetwork.IsValid() {
+		if group.DelegationPrefixLength < group.DelegationNetwork.Bits() || group.DelegationPrefixLength > group.DelegationNetwork.Addr().BitLen() {
+			return logical.ErrorResponse(fmt.Sprintf("delegation_prefix_length must be between %d and %d", group.DelegationNetwork.Bits(), group.DelegationNetwork.Addr().BitLen())), nil
+		}
+
+		for _, network := range group.Networks {
+			if network.Overlaps(group.DelegationNetwork) {
+				return logical.ErrorResponse(fmt.Sprintf("delegation_network %s overlaps network %s", group.DelegationNetwork, network)), nil
+			}
+		}
+	}
+
+	if accessRules, ok := data.GetOk("access_rules"); ok {
+		rules := []accessRule{}
+
+		for _, value := range accessRules.([]string) {
+			rule, err := parseAccessRule(value)
+			if err != nil {
+				return logical.ErrorResponse(fmt.Sprintf("error parsing access_rules: %s", err)), nil
+			}
+
+			rules = append(rules, rule)
+		}
+
+		group.AccessRules = rules
+	}
+
+	if defaultAccess, ok := data.GetOk("default_access"); ok {
+		switch defaultAccess.(string) {
+		case accessAllow:
+		case accessDeny:
+		default:
+			return logical.ErrorResponse(fmt.Sprintf("unknown default_access: %s", defaultAccess)), nil
+		}
+
+		group.DefaultAccess = defaultAccess.(string)
+	}
+
+	if dns, ok := data.GetOk("dns"); ok {
+		group.DNS = dns.([]string)
+	}
+
+	if keyPolicy, ok := data.GetOk("key_policy"); ok {
+		if err := validateKeyPolicy(keyPolicy.(string)); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+
+		group.KeyPolicy = keyPolicy.(string)
+	}
+
+	if maxTTL, ok := data.GetOk("max_ttl"); ok {
+		group.MaxTTL = maxTTL.(int)
+	}
+
+	if materializeInterval, ok := data.GetOk("materialize_interval"); ok {
+		group.MaterializeInterval = materializeInterval.(int)
+	}
+
+	if mtu, ok := data.GetOk("mtu"); ok {
+		group.MTU = mtu.(int)
 	}
 
 	if persistentKeepalive, ok := data.GetOk("persistent_keepalive"); ok {
 		group.PersistentKeepalive = persistentKeepalive.(int)
 	}
 
-	if err := b.put(ctx, req.Storage, "groups/"+name, group); err != nil {
-		return nil, err
+	if port, ok := data.GetOk("port"); ok {
+		group.Port = port.(int)
 	}
 
-	return b.updateGroupPeers(ctx, req.Storage, group.Name)
+	if presharedKeys, ok := data.GetOk("preshared_keys"); ok {
+		if err := validatePresharedKeys(presharedKeys.(string)); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+
+		group.PresharedKeys = presharedKeys.(string)
+	}
+
+	if privateKeyFile, ok := data.GetOk("private_key_file"); ok {
+		group.PrivateKeyFile = privateKeyFile.(string)
+	}
+
+	if rotationPeriod, ok := data.GetOk("rotation_period"); ok {
+		group.RotationPeriod = rotationPeriod.(int)
+	}
+
+	if topology, ok := data.GetOk("topology"); ok {
+		switch topology.(string) {
+		case topologyFullMesh:
+		case topologyHubSpoke:
+		default:
+			return logical.ErrorResponse(fmt.Sprintf("unknown topology: %s", topology)), nil
+		}
+
+		group.Topology = topology.(string)
+	}
+
+	if ttl, ok := data.GetOk("ttl"); ok {
+		group.TTL = ttl.(int)
+	}
+
+	overrides, err := group.settingsLayer().updateOverrides(data)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	group.Overrides = overrides
+
+	// The group is rebuilt from its peers, which the WAL rollback finishes if this is interrupted
+	return withWAL(ctx, req.Storage, walKindGroupRebuild, &groupWAL{
+		Group: name,
+	}, func() (*logical.Response, error) {
+		return b.updateGroupPeers(ctx, req.Storage, group, nil)
+	})
 }
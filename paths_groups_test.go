@@ -2,10 +2,14 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"net/netip"
+	"sync/atomic"
 	"testing"
 
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 func TestGroups(t *testing.T) {
@@ -37,6 +41,11 @@ func TestGroups(t *testing.T) {
 	}
 	res, err = b.HandleRequest(context.Background(), req)
 	require.Nil(t, err)
+	require.Equal(t, "network 10.0.0.0/24 overlaps network of group mygroup1", res.Error().Error())
+
+	req.Data["network"] = "10.2.0.0/24"
+	res, err = b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
 	require.Nil(t, res)
 
 	// Update
@@ -64,11 +73,41 @@ func TestGroups(t *testing.T) {
 	res, err = b.HandleRequest(context.Background(), req)
 	require.Nil(t, err)
 	require.Equal(t, map[string]interface{}{
-		"max_ttl":              60,
-		"name":                 "mygroup1",
-		"network":              "10.1.0.0/24",
-		"persistent_keepalive": 45,
-		"ttl":                  60,
+		"access_rules":             []string{},
+		"default_access":           "allow",
+		"delegation_network":       "",
+		"delegation_prefix_length": 0,
+		"dns":                      []string{},
+		"ipam_mode":                "sequential",
+		"key_policy":               "generate",
+		"materialize_interval":     0,
+		"max_ttl":                  60,
+		"mtu":                      0,
+		"name":                     "mygroup1",
+		"network":                  "10.1.0.0/24",
+		"persistent_keepalive":     45,
+		"port":                     0,
+		"preshared_keys":           "none",
+		"private_key_file":         "",
+		"rotation_period":          0,
+		"previous_network":         "",
+		"reserved_ranges":          []string{},
+		"sources": map[string]string{
+			"dns":                  "default",
+			"key_policy":           "default",
+			"materialize_interval": "default",
+			"max_ttl":              "default",
+			"mtu":                  "default",
+			"persistent_keepalive": "group",
+			"port":                 "default",
+			"preshared_keys":       "default",
+			"private_key_file":     "default",
+			"rotation_period":      "default",
+			"ttl":                  "default",
+		},
+		"state":    "settled",
+		"topology": "full_mesh",
+		"ttl":      60,
 	}, res.Data)
 
 	// Delete
@@ -111,3 +150,223 @@ func TestGroups(t *testing.T) {
 
 	b.HandleRequest(context.Background(), req)
 }
+
+func TestGroupsLegacy(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	// Groups written before peers stored their addresses
+	for key, value := range map[string]string{
+		"groups/mygroup":       `{"name":"mygroup","network":"10.0.0.0/24","peers":[{"name":"peer1","ip":"10.0.0.1/24"},{"name":"peer2","ip":"10.0.0.2/24"}]}`,
+		"groups/mygroup/peer1": `{"name":"peer1","hostname":"peer1"}`,
+		"groups/mygroup/peer2": `{"name":"peer2","hostname":"peer2"}`,
+	} {
+		require.Nil(t, s.Put(context.Background(), &logical.StorageEntry{
+			Key:   key,
+			Value: []byte(value),
+		}))
+	}
+
+	res, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      "groups/mygroup/peer1",
+		Storage:   s,
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "groups/mygroup",
+		Storage:   s,
+	})
+	require.Nil(t, err)
+	require.Equal(t, "10.0.0.0/24", res.Data["network"])
+
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "groups/mygroup/peer2",
+		Storage:   s,
+	})
+	require.Nil(t, err)
+	require.Equal(t, "10.0.0.2", res.Data["ip"])
+}
+
+// countingStorage counts the storage operations made by a backend.
+type countingStorage struct {
+	logical.Storage
+
+	gets    int64
+	largest int64
+	puts    int64
+	read    int64
+	written int64
+}
+
+func (s *countingStorage) Get(ctx context.Context, key string) (*logical.StorageEntry, error) {
+	atomic.AddInt64(&s.gets, 1)
+
+	entry, err := s.Storage.Get(ctx, key)
+	if entry != nil {
+		atomic.AddInt64(&s.read, int64(len(entry.Value)))
+	}
+
+	return entry, err
+}
+
+func (s *countingStorage) Put(ctx context.Context, entry *logical.StorageEntry) error {
+	atomic.AddInt64(&s.puts, 1)
+	atomic.AddInt64(&s.written, int64(len(entry.Value)))
+
+	for size := int64(len(entry.Value)); ; {
+		largest := atomic.LoadInt64(&s.largest)
+		if size <= largest || atomic.CompareAndSwapInt64(&s.largest, largest, size) {
+			break
+		}
+	}
+
+	return s.Storage.Put(ctx, entry)
+}
+
+// benchmarkGroup returns a backend with a group of n peers.
+func benchmarkGroup(b testing.TB, n int) (*wireguardBackend, *countingStorage, *wireguardGroup) {
+	b.Helper()
+
+	backend, storage := getTestBackend(b)
+	s := &countingStorage{
+		Storage: storage,
+	}
+	group := &wireguardGroup{
+		Name:     "mygroup",
+		Networks: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/16")},
+	}
+	ip := group.Networks[0].Addr()
+
+	for i := 0; i < n; i++ {
+		key, err := wgtypes.GeneratePrivateKey()
+		require.Nil(b, err)
+
+		ip = ip.Next()
+		name := fmt.Sprintf("peer%05d", i)
+		require.Nil(b, backend.put(context.Background(), s, "groups/mygroup/"+name, &wireguardPeer{
+			Hostname:   name,
+			IPs:        []netip.Addr{ip},
+			Name:       name,
+			PrivateKey: key.String(),
+			PublicKey:  key.PublicKey().String(),
+		}))
+	}
+
+	res, err := backend.updateGroupPeers(context.Background(), s, group, nil)
+	require.Nil(b, err)
+	require.Nil(b, res)
+
+	return backend, s, group
+}
+
+// resetStorage resets the counters of the storage before a benchmark.
+func resetStorage(s *countingStorage) {
+	atomic.StoreInt64(&s.gets, 0)
+	atomic.StoreInt64(&s.largest, 0)
+	atomic.StoreInt64(&s.puts, 0)
+	atomic.StoreInt64(&s.read, 0)
+	atomic.StoreInt64(&s.written, 0)
+}
+
+// reportStorage reports the storage operations and bytes read and written per operation, and the largest entry written.
+func reportStorage(b *testing.B, s *countingStorage) {
+	b.ReportMetric(float64(atomic.LoadInt64(&s.read))/float64(b.N), "B-read/op")
+	b.ReportMetric(float64(atomic.LoadInt64(&s.written))/float64(b.N), "B-written/op")
+	b.ReportMetric(float64(atomic.LoadInt64(&s.largest)), "B-largest-entry")
+	b.ReportMetric(float64(atomic.LoadInt64(&s.gets))/float64(b.N), "gets/op")
+	b.ReportMetric(float64(atomic.LoadInt64(&s.puts))/float64(b.N), "puts/op")
+}
+
+// Peer writes only read the entries of that peer, however big the group is
+func TestGroupPeerWriteCost(t *testing.T) {
+	read := map[int]int64{}
+
+	for _, n := range []int{100, 1000} {
+		backend, s, _ := benchmarkGroup(t, n)
+		resetStorage(s)
+
+		for i := 0; i < 4; i++ {
+			res, err := backend.HandleRequest(context.Background(), &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "groups/mygroup/peer00001",
+				Storage:   s,
+				Data: map[string]interface{}{
+					"allowed_ips": fmt.Sprintf("192.168.%d.0/24", i),
+				},
+			})
+			require.Nil(t, err)
+			require.Nil(t, res)
+		}
+
+		read[n] = atomic.LoadInt64(&s.read)
+	}
+
+	require.Equal(t, read[100], read[1000])
+}
+
+func BenchmarkGroupPeers10k(b *testing.B) {
+	backend, s, group := benchmarkGroup(b, 10000)
+
+	b.Run("write", func(b *testing.B) {
+		resetStorage(s)
+
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			res, err := backend.HandleRequest(context.Background(), &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "groups/mygroup/peer00001",
+				Storage:   s,
+				Data: map[string]interface{}{
+					"port": 51820 + i%2,
+				},
+			})
+			require.Nil(b, err)
+			require.Nil(b, res)
+		}
+
+		reportStorage(b, s)
+	})
+
+	b.Run("create_delete", func(b *testing.B) {
+		resetStorage(s)
+
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			operation := logical.CreateOperation
+			if i%2 == 1 {
+				operation = logical.DeleteOperation
+			}
+
+			res, err := backend.HandleRequest(context.Background(), &logical.Request{
+				Operation: operation,
+				Path:      "groups/mygroup/new",
+				Storage:   s,
+			})
+			require.Nil(b, err)
+			require.Nil(b, res)
+		}
+
+		reportStorage(b, s)
+	})
+
+	// The full rebuild each peer write used to do
+	b.Run("rebuild", func(b *testing.B) {
+		resetStorage(s)
+
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			res, err := backend.updateGroupPeers(context.Background(), s, group, nil)
+			require.Nil(b, err)
+			require.Nil(b, res)
+		}
+
+		reportStorage(b, s)
+	})
+}
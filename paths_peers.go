@@ -5,6 +5,9 @@ import (
 	"context"
 	"fmt"
 	"net/netip"
+	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
@@ -13,12 +16,59 @@ import (
 )
 
 type wireguardPeer struct {
-	AllowedIPs []string `json:"allowed_ips" mapstructure:"allowed_ips"`
-	Hostname   string   `json:"hostname" mapstructure:"hostname"`
-	Name       string   `json:"name" mapstructure:"name"`
-	Port       int      `json:"port" mapstructure:"port"`
-	PrivateKey string   `json:"private_key" mapstructure:"private_key"`
-	PublicKey  string   `json:"public_key" mapstructure:"public_key"`
+	AllowedIPs          []string            `json:"allowed_ips" mapstructure:"allowed_ips"`
+	DNS                 []string            `json:"dns" mapstructure:"dns"`
+	DelegatedPrefix     netip.Prefix        `json:"delegated_prefix" mapstructure:"delegated_prefix"`
+	Endpoints           []wireguardEndpoint `json:"endpoints" mapstructure:"endpoints"`
+	ExitNode            bool                `json:"exit_node" mapstructure:"exit_node"`
+	Hostname            string              `json:"hostname" mapstructure:"hostname"`
+	Hub                 bool                `json:"hub" mapstructure:"hub"`
+	IPs                 []netip.Addr        `json:"ips" mapstructure:"ips"`
+	KeyCreatedAt        time.Time           `json:"key_created_at" mapstructure:"key_created_at"`
+	KeyPolicy           string              `json:"key_policy" mapstructure:"key_policy"`
+	Labels              []string            `json:"labels" mapstructure:"labels"`
+	MTU                 int                 `json:"mtu" mapstructure:"mtu"`
+	Name                string              `json:"name" mapstructure:"name"`
+	Overrides           []string            `json:"overrides" mapstructure:"-"`
+	PersistentKeepalive int                 `json:"persistent_keepalive" mapstructure:"persistent_keepalive"`
+	Port                int                 `json:"port" mapstructure:"port"`
+	PresharedKeys       map[string]string   `json:"-" mapstructure:"-"`
+	PreviousIPs         []netip.Addr        `json:"previous_ips" mapstructure:"previous_ips"`
+	PrivateKey          string              `json:"-" mapstructure:"-"`
+	PrivateKeyFile      string              `json:"private_key_file" mapstructure:"private_key_file"`
+	PublicKey           string              `json:"public_key" mapstructure:"public_key"`
+	Relay               bool                `json:"relay" mapstructure:"relay"`
+	RotatedAt           time.Time           `json:"rotated_at" mapstructure:"rotated_at"`
+	RotationPeriod      int                 `json:"rotation_period" mapstructure:"rotation_period"`
+	Site                string              `json:"site" mapstructure:"site"`
+	Table               string              `json:"table" mapstructure:"table"`
+	Tunnel              string              `json:"tunnel" mapstructure:"tunnel"`
+}
+
+// wireguardPeerCreds are the secrets of a peer.  They are stored apart from the peer, so they can be seal wrapped and read with their own policy.
+type wireguardPeerCreds struct {
+	PresharedKeys map[string]string `json:"preshared_keys,omitempty"`
+	PrivateKey    string            `json:"private_key,omitempty"`
+}
+
+func credsPath(groupname, name string) string {
+	return "creds/" + groupname + "/" + name
+}
+
+func (p *wireguardPeer) settingsLayer() settingsLayer {
+	return settingsLayer{
+		Overrides: p.Overrides,
+		Source:    settingsSourcePeer,
+		Values: map[string]interface{}{
+			"dns":                  p.DNS,
+			"key_policy":           p.KeyPolicy,
+			"mtu":                  p.MTU,
+			"persistent_keepalive": p.PersistentKeepalive,
+			"port":                 p.Port,
+			"private_key_file":     p.PrivateKeyFile,
+			"rotation_period":      p.RotationPeriod,
+		},
+	}
 }
 
 func getPeer(ctx context.Context, s logical.Storage, groupname, name string) (*wireguardPeer, error) {
@@ -45,9 +95,68 @@ func getPeer(ctx context.Context, s logical.Storage, groupname, name string) (*w
 		return nil, fmt.Errorf("error decoding peer data: %w", err)
 	}
 
+	// Peers used to have a single address
+	if len(peer.IPs) == 0 {
+		var legacy struct {
+			IP netip.Addr `json:"ip"`
+		}
+
+		if err := entry.DecodeJSON(&legacy); err != nil {
+			return nil, fmt.Errorf("error decoding peer data: %w", err)
+		}
+
+		if legacy.IP.IsValid() {
+			peer.IPs = []netip.Addr{legacy.IP}
+		}
+	}
+
+	credsEntry, err := s.Get(ctx, credsPath(groupname, name))
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving peer creds: %w", err)
+	}
+
+	// Peers used to store their secrets in the peer entry, with the same keys
+	if credsEntry == nil {
+		credsEntry = entry
+	}
+
+	var creds wireguardPeerCreds
+
+	if err := credsEntry.DecodeJSON(&creds); err != nil {
+		return nil, fmt.Errorf("error decoding peer creds data: %w", err)
+	}
+
+	peer.PresharedKeys = creds.PresharedKeys
+	peer.PrivateKey = creds.PrivateKey
+
 	return &peer, nil
 }
 
+// putPeer saves a peer and its secrets.
+func (b *wireguardBackend) putPeer(ctx context.Context, s logical.Storage, groupname, name string, peer *wireguardPeer) error {
+	if peer.PrivateKey == "" && len(peer.PresharedKeys) == 0 {
+		if err := b.delete(ctx, s, credsPath(groupname, name)); err != nil {
+			return err
+		}
+	} else if err := b.put(ctx, s, credsPath(groupname, name), &wireguardPeerCreds{
+		PresharedKeys: peer.PresharedKeys,
+		PrivateKey:    peer.PrivateKey,
+	}); err != nil {
+		return err
+	}
+
+	return b.put(ctx, s, "groups/"+groupname+"/"+name, peer)
+}
+
+// deletePeer deletes a peer and its secrets.
+func (b *wireguardBackend) deletePeer(ctx context.Context, s logical.Storage, groupname, name string) error {
+	if err := b.delete(ctx, s, "groups/"+groupname+"/"+name); err != nil {
+		return err
+	}
+
+	return b.delete(ctx, s, credsPath(groupname, name))
+}
+
 func (b *wireguardBackend) pathPeersList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
 	entries, err := req.Storage.List(ctx, "groups/"+data.Get("name").(string)+"/")
 	if err != nil {
@@ -60,20 +169,46 @@ func (b *wireguardBackend) pathPeersList(ctx context.Context, req *logical.Reque
 func (b *wireguardBackend) pathPeersDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
 	groupname := data.Get("group_name").(string)
 
-	b.lock.Lock()
+	lock := b.groupLock(groupname)
+	lock.Lock()
+	defer lock.Unlock()
 
-	if err := req.Storage.Delete(ctx, "groups/"+groupname+"/"+data.Get("name").(string)); err != nil {
-		b.lock.Unlock()
-		return nil, err
+	group, err := b.getGroup(ctx, req.Storage, groupname)
+	if err != nil || group == nil {
+		return logical.ErrorResponse("missing group"), err
 	}
 
-	b.lock.Unlock()
+	name := data.Get("name").(string)
 
-	return b.updateGroupPeers(ctx, req.Storage, groupname)
+	return b.savePeer(ctx, req.Storage, group, name, nil)
+}
+
+// savePeer saves a peer, or deletes it if peer is nil, and updates its directory entry.  The group lock must be held.
+func (b *wireguardBackend) savePeer(ctx context.Context, s logical.Storage, group *wireguardGroup, name string, peer *wireguardPeer) (*logical.Response, error) {
+	return withWAL(ctx, s, walKindPeer, &peerWAL{
+		Group: group.Name,
+		Peer:  name,
+	}, func() (*logical.Response, error) {
+		if peer == nil {
+			if err := b.deletePeer(ctx, s, group.Name, name); err != nil {
+				return nil, err
+			}
+		} else if err := b.putPeer(ctx, s, group.Name, name, peer); err != nil {
+			return nil, err
+		}
+
+		return b.updateGroupPeer(ctx, s, group, name, peer)
+	})
 }
 
 func (b *wireguardBackend) pathPeersRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-	peer, err := getPeer(ctx, req.Storage, data.Get("group_name").(string), data.Get("name").(string))
+	groupname := data.Get("group_name").(string)
+
+	lock := b.groupLock(groupname)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	peer, err := getPeer(ctx, req.Storage, groupname, data.Get("name").(string))
 	if err != nil {
 		return nil, err
 	}
@@ -82,6 +217,21 @@ func (b *wireguardBackend) pathPeersRead(ctx context.Context, req *logical.Reque
 		return nil, nil
 	}
 
+	group, err := b.getGroup(ctx, req.Storage, groupname)
+	if err != nil || group == nil {
+		return logical.ErrorResponse("missing group"), err
+	}
+
+	config, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	// Peers written before addresses were stored use the address they were rendered with
+	if len(peer.IPs) == 0 {
+		peer.IPs = groupIPs(group)[peer.Name]
+	}
+
 	var groupMap map[string]interface{}
 
 	err = mapstructure.Decode(peer, &groupMap)
@@ -89,11 +239,68 @@ func (b *wireguardBackend) pathPeersRead(ctx context.Context, req *logical.Reque
 		return nil, err
 	}
 
+	settingsResponse(resolveSettings(config.settingsLayer(), group.settingsLayer(), peer.settingsLayer()), groupMap, "dns", "key_policy", "mtu", "persistent_keepalive", "port", "private_key_file", "rotation_period")
+
+	delete(groupMap, "ips")
+	delete(groupMap, "previous_ips")
+	groupMap["delegated_prefix"] = ""
+
+	endpoints := make([]string, len(peer.Endpoints))
+	for i := range peer.Endpoints {
+		endpoints[i] = peer.Endpoints[i].String()
+	}
+
+	groupMap["endpoints"] = endpoints
+
+	if peer.Tunnel == "" {
+		groupMap["tunnel"] = tunnelSplit
+	}
+	groupMap["ip"] = joinAddrs(peer.IPs)
+	groupMap["key_created_at"] = formatTime(peer.KeyCreatedAt)
+	groupMap["previous_ip"] = joinAddrs(peer.PreviousIPs)
+	groupMap["rotated_at"] = formatTime(peer.RotatedAt)
+
+	if peer.DelegatedPrefix.IsValid() {
+		groupMap["delegated_prefix"] = peer.DelegatedPrefix.String()
+	}
+
+	groupMap["state"] = stateSettled
+
+	pending, err := req.Storage.Get(ctx, "pending/"+groupname+"/"+peer.Name)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving pending peer: %w", err)
+	}
+
+	if pending != nil {
+		groupMap["state"] = statePending
+	}
+
 	return &logical.Response{
 		Data: groupMap,
 	}, nil
 }
 
+// pathPeersCredsRead returns the private key of a peer, which isn't returned by pathPeersRead.
+func (b *wireguardBackend) pathPeersCredsRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	groupname := data.Get("group_name").(string)
+
+	lock := b.groupLock(groupname)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	peer, err := getPeer(ctx, req.Storage, groupname, data.Get("name").(string))
+	if err != nil || peer == nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"private_key": peer.PrivateKey,
+			"public_key":  peer.PublicKey,
+		},
+	}, nil
+}
+
 func (b *wireguardBackend) pathPeersWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
 	groupname := data.Get("group_name").(string)
 	if groupname == "" {
@@ -105,11 +312,23 @@ func (b *wireguardBackend) pathPeersWrite(ctx context.Context, req *logical.Requ
 		return logical.ErrorResponse("missing name"), nil
 	}
 
-	group, err := getGroup(ctx, req.Storage, groupname)
+	b.configLock.RLock()
+	defer b.configLock.RUnlock()
+
+	lock := b.groupLock(groupname)
+	lock.Lock()
+	defer lock.Unlock()
+
+	group, err := b.getGroup(ctx, req.Storage, groupname)
 	if err != nil || group == nil {
 		return logical.ErrorResponse("missing group"), err
 	}
 
+	// Addresses are checked against peers that haven't been materialized yet
+	if _, err := applyPendingPeers(ctx, req.Storage, group); err != nil {
+		return nil, err
+	}
+
 	peer, err := getPeer(ctx, req.Storage, groupname, name)
 	if err != nil {
 		return logical.ErrorResponse("missing peer"), err
@@ -120,8 +339,15 @@ func (b *wireguardBackend) pathPeersWrite(ctx context.Context, req *logical.Requ
 	}
 
 	peer.Name = name
+	oldPublicKey := peer.PublicKey
 
 	if allowedIPs, ok := data.GetOk("allowed_ips"); ok {
+		// Peers can route prefixes of their own group network
+		networks, _, err := addressSpaceUsage(ctx, req.Storage, groupname)
+		if err != nil {
+			return nil, err
+		}
+
 		prefixes := []string{}
 
 		for _, ip := range allowedIPs.([]string) {
@@ -130,22 +356,196 @@ func (b *wireguardBackend) pathPeersWrite(ctx context.Context, req *logical.Requ
 				return logical.ErrorResponse(fmt.Sprintf("error parsing allowed_ips %s: %e", ip, err)), err
 			}
 
+			if overlap := findOverlap(prefix, networks); overlap != nil && prefix.Bits() > 0 {
+				return logical.ErrorResponse(fmt.Sprintf("allowed_ips %s overlaps %s", prefix, overlap.Owner)), nil
+			}
+
 			prefixes = append(prefixes, prefix.String())
 		}
 
 		peer.AllowedIPs = prefixes
 	}
 
+	if endpoints, ok := data.GetOk("endpoints"); ok {
+		peer.Endpoints = []wireguardEndpoint{}
+
+		for _, value := range endpoints.([]string) {
+			endpoint, err := parseEndpoint(value)
+			if err != nil {
+				return logical.ErrorResponse(fmt.Sprintf("error parsing endpoints: %s", err)), nil
+			}
+
+			peer.Endpoints = append(peer.Endpoints, endpoint)
+		}
+	}
+
+	if exitNode, ok := data.GetOk("exit_node"); ok {
+		peer.ExitNode = exitNode.(bool)
+	}
+
 	if hostname, ok := data.GetOk("hostname"); ok && hostname != "" {
 		peer.Hostname = hostname.(string)
 	} else {
 		peer.Hostname = name
 	}
 
+	if dns, ok := data.GetOk("dns"); ok {
+		peer.DNS = dns.([]string)
+	}
+
+	if hub, ok := data.GetOk("hub"); ok {
+		peer.Hub = hub.(bool)
+	}
+
+	if keyPolicy, ok := data.GetOk("key_policy"); ok {
+		if err := validateKeyPolicy(keyPolicy.(string)); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+
+		peer.KeyPolicy = keyPolicy.(string)
+	}
+
+	if labels, ok := data.GetOk("labels"); ok {
+		peer.Labels = labels.([]string)
+	}
+
+	if mtu, ok := data.GetOk("mtu"); ok {
+		peer.MTU = mtu.(int)
+	}
+
+	if persistentKeepalive, ok := data.GetOk("persistent_keepalive"); ok {
+		peer.PersistentKeepalive = persistentKeepalive.(int)
+	}
+
 	if port, ok := data.GetOk("port"); ok {
 		peer.Port = port.(int)
 	}
 
+	if privateKeyFile, ok := data.GetOk("private_key_file"); ok {
+		peer.PrivateKeyFile = privateKeyFile.(string)
+	}
+
+	if relay, ok := data.GetOk("relay"); ok {
+		peer.Relay = relay.(bool)
+	}
+
+	if rotationPeriod, ok := data.GetOk("rotation_period"); ok {
+		peer.RotationPeriod = rotationPeriod.(int)
+	}
+
+	if site, ok := data.GetOk("site"); ok {
+		peer.Site = site.(string)
+	}
+
+	if table, ok := data.GetOk("table"); ok {
+		if _, err := strconv.Atoi(table.(string)); err != nil && table != "" && table != "auto" && table != "off" {
+			return logical.ErrorResponse(fmt.Sprintf("table must be auto, off or a routing table number: %s", table)), nil
+		}
+
+		peer.Table = table.(string)
+	}
+
+	if tunnel, ok := data.GetOk("tunnel"); ok {
+		switch tunnel.(string) {
+		case tunnelFull:
+		case tunnelSplit:
+		default:
+			return logical.ErrorResponse(fmt.Sprintf("unknown tunnel: %s", tunnel)), nil
+		}
+
+		peer.Tunnel = tunnel.(string)
+	}
+
+	used := ipSet{}
+
+	for peerName, ips := range groupIPs(group) {
+		if peerName != name {
+			for _, ip := range ips {
+				used.add(ip)
+			}
+		}
+	}
+
+	if ips, ok := data.GetOk("ip"); ok {
+		pinned := make([]netip.Addr, len(group.Networks))
+
+		for _, ip := range ips.([]string) {
+			addr, err := netip.ParseAddr(ip)
+			if err != nil {
+				return logical.ErrorResponse(fmt.Sprintf("error parsing ip: %s", err)), nil
+			}
+
+			i := 0
+			for i < len(group.Networks) && !isHostAddr(group.Networks[i], addr) {
+				i++
+			}
+
+			if i == len(group.Networks) {
+				return logical.ErrorResponse(fmt.Sprintf("ip %s is not a usable address in network %s", addr, joinPrefixes(group.Networks))), nil
+			}
+
+			if pinned[i].IsValid() {
+				return logical.ErrorResponse(fmt.Sprintf("only one ip per network is allowed: %s and %s", pinned[i], addr)), nil
+			}
+
+			if used.has(addr) {
+				for peerName, other := range groupIPs(group) {
+					if peerName != name && addrIn(group.Networks[i], other) == addr {
+						return logical.ErrorResponse(fmt.Sprintf("ip %s is already used by peer %s", addr, peerName)), nil
+					}
+				}
+			}
+
+			pinned[i] = addr
+		}
+
+		ips := []netip.Addr{}
+
+		for i, ip := range pinned {
+			if !ip.IsValid() {
+				ip = addrIn(group.Networks[i], peer.IPs)
+			}
+
+			if ip.IsValid() {
+				ips = append(ips, ip)
+			}
+		}
+
+		peer.IPs = ips
+	}
+
+	overrides, err := peer.settingsLayer().updateOverrides(data)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	peer.Overrides = overrides
+
+	config, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := resolveSettings(config.settingsLayer(), group.settingsLayer(), peer.settingsLayer())
+	keyPolicy := settings.string("key_policy")
+
+	if peer.Relay && settings.int("port") == 0 {
+		return logical.ErrorResponse("relay peers need a port"), nil
+	}
+
+	if peer.ExitNode && settings.int("port") == 0 {
+		return logical.ErrorResponse("exit nodes need a port"), nil
+	}
+
+	if keyPolicy == keyPolicyClient {
+		if _, ok := data.GetOk("private_key"); ok {
+			return logical.ErrorResponse("key_policy client doesn't allow storing a private_key, provide a public_key instead"), nil
+		}
+
+		// Keys stored before the peer held its own key are dropped
+		peer.PrivateKey = ""
+	}
+
 	if privateKey, ok := data.GetOk("private_key"); ok {
 		key, err := wgtypes.ParseKey(privateKey.(string))
 		if err != nil {
@@ -161,6 +561,13 @@ func (b *wireguardBackend) pathPeersWrite(ctx context.Context, req *logical.Requ
 	}
 
 	if peer.PrivateKey == "" && peer.PublicKey == "" {
+		switch keyPolicy {
+		case keyPolicyClient:
+			return logical.ErrorResponse("key_policy client requires a public_key to be provided"), nil
+		case keyPolicyProvided:
+			return logical.ErrorResponse("key_policy requires a private_key or public_key to be provided"), nil
+		}
+
 		key, err := wgtypes.GeneratePrivateKey()
 		if err != nil {
 			return logical.ErrorResponse(fmt.Sprintf("error generating private_key: %e", err)), err
@@ -170,11 +577,33 @@ func (b *wireguardBackend) pathPeersWrite(ctx context.Context, req *logical.Requ
 		peer.PublicKey = key.PublicKey().String()
 	}
 
-	if err := b.put(ctx, req.Storage, "groups/"+groupname+"/"+name, peer); err != nil {
-		return nil, err
+	if oldPublicKey != peer.PublicKey {
+		peer.KeyCreatedAt = time.Now()
+
+		if oldPublicKey != "" {
+			peer.RotatedAt = peer.KeyCreatedAt
+		}
+	}
+
+	_, pinned := data.GetOk("ip")
+
+	if group.IPAMMode == ipamModeKey && oldPublicKey != "" && oldPublicKey != peer.PublicKey && !pinned {
+		// Addresses derived from the old key are released
+		peer.IPs = nil
+	} else if len(peer.IPs) == 0 {
+		peer.IPs = groupIPs(group)[name]
 	}
 
-	return b.updateGroupPeers(ctx, req.Storage, groupname)
+	peer.IPs, err = allocateIPs(group.Networks, peer.IPs, used, group.ReservedRanges, group.ipamKey(peer))
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("error allocating address: %s", err)), nil
+	}
+
+	if err := delegatePrefix(group, peer, groupDelegatedPrefixes(group, name)); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("error delegating prefix: %s", err)), nil
+	}
+
+	return b.savePeer(ctx, req.Storage, group, name, peer)
 }
 
 func (b *wireguardBackend) pathPeersWGQuickRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
@@ -188,25 +617,116 @@ func (b *wireguardBackend) pathPeersWGQuickRead(ctx context.Context, req *logica
 		return logical.ErrorResponse("missing name"), nil
 	}
 
-	group, err := getGroup(ctx, req.Storage, groupname)
+	lock := b.groupLock(groupname)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	generation := atomic.LoadUint64(&b.cacheGeneration)
+
+	group, err := b.getCachedGroup(ctx, req.Storage, groupname)
 	if err != nil || group == nil {
 		return logical.ErrorResponse("unable to find group"), nil
 	}
 
+	state, err := groupState(ctx, req.Storage, groupname)
+	if err != nil {
+		return nil, err
+	}
+
+	key := "wg-quick/" + groupname + "/" + name
+
+	if cached, ok := b.cache.Get(key); ok && cached.(*renderedConfig).Group == group {
+		return cached.(*renderedConfig).response(state), nil
+	}
+
+	engineConfig, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	peer, err := getPeer(ctx, req.Storage, groupname, name)
+	if err != nil || peer == nil {
+		return logical.ErrorResponse("unable to find peer"), err
+	}
+
+	groupPSK, err := getGroupPSK(ctx, req.Storage, groupname)
+	if err != nil {
+		return nil, err
+	}
+
+	// Peers that haven't been added to the directory yet render their interface from their own entry
+	cachedGroup := group
+
+	viewer, settled := directoryPeer(group, name)
+	if !settled {
+		if len(peer.IPs) != len(group.Networks) {
+			return logical.ErrorResponse(fmt.Sprintf("peer %s doesn't have an address in every group network yet", name)), nil
+		}
+
+		group = group.clone()
+		applyGroupPeer(group, name, peer)
+		viewer, _ = directoryPeer(group, name)
+	}
+
+	peers := relayPeers(group, topologyPeers(group, wgQuickPeers(group, engineConfig, viewer.Site), viewer), viewer)
+
+	if peer.Tunnel == tunnelFull && !routeDefault(peers, name) {
+		return logical.ErrorResponse(fmt.Sprintf("peer %s uses a full tunnel, but can't reach an exit node", name)), nil
+	}
+
+	for i := range peers {
+		peers[i].PresharedKey = groupPSK
+
+		if psk, ok := peer.PresharedKeys[peers[i].Name]; ok {
+			peers[i].PresharedKey = psk
+		}
+	}
+
+	s := resolveSettings(engineConfig.settingsLayer(), group.settingsLayer(), peer.settingsLayer())
+
 	var config bytes.Buffer
 
-	if err := wgQuickTemplate.Execute(&config, wgQuickValues{
-		Group: group,
-		Name:  name,
-	}); err != nil {
+	values := wgQuickValues{
+		DNS:        s.strings("dns"),
+		Group:      group,
+		MTU:        s.int("mtu"),
+		FullTunnel: peer.Tunnel == tunnelFull,
+		Name:       name,
+		Peers:      peers,
+		PrivateKey: peer.PrivateKey,
+		Table:      peer.Table,
+	}
+
+	if viewer.Relay || viewer.ExitNode || (viewer.Hub && group.Topology == topologyHubSpoke) {
+		values.PostUp = forwardingPostUp(group)
+	}
+
+	if viewer.ExitNode {
+		postUp, postDown := natRules(group, viewer.Relay || (viewer.Hub && group.Topology == topologyHubSpoke))
+		values.PostUp = append(values.PostUp, postUp...)
+		values.PostDown = postDown
+	}
+
+	if s.string("key_policy") == keyPolicyClient || peer.PrivateKey == "" {
+		values.PrivateKey = ""
+		values.PrivateKeyFile = s.string("private_key_file")
+	}
+
+	if err := wgQuickTemplate.Execute(&config, values); err != nil {
 		return logical.ErrorResponse("error rendering config: %w", err), nil
 	}
 
-	return &logical.Response{
-		Data: map[string]interface{}{
-			"config":  config.String(),
-			"max_ttl": group.MaxTTL,
-			"ttl":     group.TTL,
-		},
-	}, nil
+	rendered := &renderedConfig{
+		Config: config.String(),
+		Group:  cachedGroup,
+		MaxTTL: s.int("max_ttl"),
+		TTL:    s.int("ttl"),
+	}
+
+	// Don't cache a config that may have been rendered from changed entries, or that the directory doesn't have the peer for yet
+	if settled && atomic.LoadUint64(&b.cacheGeneration) == generation {
+		b.cache.Add(key, rendered)
+	}
+
+	return rendered.response(state), nil
 }
@@ -2,11 +2,17 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
 	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 const publicKey = "lpTCQOdhnt1nTRdcuhuVLNNhk6Azr2WDZ1xJKofUfnE="
@@ -121,15 +127,64 @@ func TestPeers(t *testing.T) {
 	require.Nil(t, err)
 	var str []string
 	peer3 := map[string]interface{}{
-		"allowed_ips": str,
-		"hostname":    "peer3",
-		"name":        "peer3",
-		"port":        51820,
-		"public_key":  res.Data["public_key"],
-		"private_key": res.Data["private_key"],
+		"allowed_ips":          str,
+		"delegated_prefix":     "",
+		"dns":                  []string{},
+		"endpoints":            []string{},
+		"exit_node":            false,
+		"hostname":             "peer3",
+		"hub":                  false,
+		"ip":                   "10.0.0.3",
+		"key_created_at":       res.Data["key_created_at"],
+		"key_policy":           "generate",
+		"labels":               str,
+		"mtu":                  0,
+		"name":                 "peer3",
+		"persistent_keepalive": 30,
+		"port":                 51820,
+		"previous_ip":          "",
+		"private_key_file":     "",
+		"public_key":           res.Data["public_key"],
+		"relay":                false,
+		"rotated_at":           "",
+		"rotation_period":      0,
+		"site":                 "",
+		"sources": map[string]string{
+			"dns":                  "default",
+			"key_policy":           "default",
+			"mtu":                  "default",
+			"persistent_keepalive": "group",
+			"port":                 "peer",
+			"private_key_file":     "default",
+			"rotation_period":      "default",
+		},
+		"state":  "settled",
+		"table":  "",
+		"tunnel": "split",
 	}
 	require.Equal(t, peer3, res.Data)
 
+	// Private keys are only returned by the creds path, and are stored apart from the peer
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "groups/mygroup/peer2/creds",
+		Storage:   s,
+	})
+	require.Nil(t, err)
+	require.Equal(t, map[string]interface{}{
+		"private_key": privateKey,
+		"public_key":  publicKey,
+	}, res.Data)
+
+	entry, err := s.Get(context.Background(), "groups/mygroup/peer2")
+	require.Nil(t, err)
+	require.NotContains(t, string(entry.Value), privateKey)
+
+	entry, err = s.Get(context.Background(), "creds/mygroup/peer2")
+	require.Nil(t, err)
+	require.Contains(t, string(entry.Value), privateKey)
+	require.Contains(t, b.SpecialPaths().SealWrapStorage, "creds/")
+
 	// Delete
 	req = &logical.Request{
 		Operation: logical.DeleteOperation,
@@ -181,3 +236,1169 @@ AllowedIPs=10.0.0.3/32
 Endpoint=peer3:51820
 `, privateKey, publicKey, peer3["public_key"]), res.Data["config"])
 }
+
+func TestPeersAddresses(t *testing.T) {
+	b, s := getTestBackend(t)
+	req := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/mygroup",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"network": "10.0.0.0/29",
+		},
+	}
+	b.HandleRequest(context.Background(), req)
+
+	getIP := func(name string) string {
+		res, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "groups/mygroup/" + name,
+			Storage:   s,
+		})
+		require.Nil(t, err)
+
+		return res.Data["ip"].(string)
+	}
+
+	for _, name := range []string{"d", "c", "b", "a"} {
+		res, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      "groups/mygroup/" + name,
+			Storage:   s,
+		})
+		require.Nil(t, err)
+		require.Nil(t, res)
+	}
+
+	require.Equal(t, "10.0.0.1", getIP("d"))
+	require.Equal(t, "10.0.0.4", getIP("a"))
+
+	// Deleting a peer doesn't renumber the others
+	res, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      "groups/mygroup/c",
+		Storage:   s,
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+	require.Equal(t, "10.0.0.1", getIP("d"))
+	require.Equal(t, "10.0.0.3", getIP("b"))
+	require.Equal(t, "10.0.0.4", getIP("a"))
+
+	// Freed addresses are reused
+	for _, name := range []string{"e", "f", "g"} {
+		res, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      "groups/mygroup/" + name,
+			Storage:   s,
+		})
+		require.Nil(t, err)
+		require.Nil(t, res)
+	}
+
+	require.Equal(t, "10.0.0.2", getIP("e"))
+	require.Equal(t, "10.0.0.6", getIP("g"))
+
+	// Updating a peer keeps its address
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "groups/mygroup/a",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"port": 51820,
+		},
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+	require.Equal(t, "10.0.0.4", getIP("a"))
+
+	// Full pool
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/mygroup/h",
+		Storage:   s,
+	})
+	require.Nil(t, err)
+	require.Equal(t, "error allocating address: no free addresses left in group network", res.Error().Error())
+
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "groups/mygroup/h",
+		Storage:   s,
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+}
+
+func TestPeersStaticAddresses(t *testing.T) {
+	b, s := getTestBackend(t)
+	req := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/mygroup",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"network":         "10.0.0.0/24",
+			"reserved_ranges": "10.0.0.0/30,10.0.0.128/25",
+		},
+	}
+	res, err := b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	req = &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/badgroup",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"network":         "10.9.0.0/24",
+			"reserved_ranges": "10.1.0.0/30",
+		},
+	}
+	res, err = b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Equal(t, "reserved range 10.1.0.0/30 is not within network 10.9.0.0/24", res.Error().Error())
+
+	tests := []struct {
+		name string
+		ip   string
+		err  string
+		want string
+	}{
+		{name: "hub", ip: "10.0.0.1", want: "10.0.0.1"},
+		{name: "auto", want: "10.0.0.4"},
+		{name: "conflict", ip: "10.0.0.1", err: "ip 10.0.0.1 is already used by peer hub"},
+		{name: "outside", ip: "10.1.0.1", err: "ip 10.1.0.1 is not a usable address in network 10.0.0.0/24"},
+		{name: "broadcast", ip: "10.0.0.255", err: "ip 10.0.0.255 is not a usable address in network 10.0.0.0/24"},
+		{name: "invalid", ip: "10.0.0", err: `error parsing ip: ParseAddr("10.0.0"): IPv4 address too short`},
+		{name: "gateway", ip: "10.0.0.200", want: "10.0.0.200"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			data := map[string]interface{}{}
+			if tc.ip != "" {
+				data["ip"] = tc.ip
+			}
+
+			res, err := b.HandleRequest(context.Background(), &logical.Request{
+				Operation: logical.CreateOperation,
+				Path:      "groups/mygroup/" + tc.name,
+				Storage:   s,
+				Data:      data,
+			})
+			require.Nil(t, err)
+
+			if tc.err != "" {
+				require.Equal(t, tc.err, res.Error().Error())
+
+				return
+			}
+
+			require.Nil(t, res)
+
+			res, err = b.HandleRequest(context.Background(), &logical.Request{
+				Operation: logical.ReadOperation,
+				Path:      "groups/mygroup/" + tc.name,
+				Storage:   s,
+			})
+			require.Nil(t, err)
+			require.Equal(t, tc.want, res.Data["ip"])
+		})
+	}
+}
+
+func TestPeersLargeReservedRanges(t *testing.T) {
+	b, s := getTestBackend(t)
+	res, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/mygroup",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"network":         "fd00::/64",
+			"reserved_ranges": "fd00::/65,fd00::8000:0:0:0/96",
+		},
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	// Reserved ranges are skipped as a whole instead of one address at a time
+	for i, want := range []string{"fd00::8000:1:0:0", "fd00::8000:1:0:1"} {
+		res, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      fmt.Sprintf("groups/mygroup/peer%d", i+1),
+			Storage:   s,
+		})
+		require.Nil(t, err)
+		require.Nil(t, res)
+
+		res, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      fmt.Sprintf("groups/mygroup/peer%d", i+1),
+			Storage:   s,
+		})
+		require.Nil(t, err)
+		require.Equal(t, want, res.Data["ip"])
+	}
+}
+
+func TestPeersDualStack(t *testing.T) {
+	b, s := getTestBackend(t)
+	req := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/mygroup",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"network": "10.0.0.0/24,fd00::/64",
+		},
+	}
+	res, err := b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/badgroup",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"network": "10.0.0.0/24,10.1.0.0/24",
+		},
+	})
+	require.Nil(t, err)
+	require.Equal(t, "error parsing network: only one network per address family is allowed: 10.0.0.0/24 and 10.1.0.0/24", res.Error().Error())
+
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/mygroup/peer1",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"port":        51820,
+			"private_key": privateKey,
+		},
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/mygroup/peer2",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"ip":         "fd00::20",
+			"public_key": publicKey,
+		},
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "groups/mygroup",
+		Storage:   s,
+	})
+	require.Nil(t, err)
+	require.Equal(t, "10.0.0.0/24,fd00::/64", res.Data["network"])
+
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "groups/mygroup/peer2",
+		Storage:   s,
+	})
+	require.Nil(t, err)
+	require.Equal(t, "10.0.0.2,fd00::20", res.Data["ip"])
+
+	// Pinning one family keeps the other address
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "groups/mygroup/peer2",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"ip": "10.0.0.20",
+		},
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "groups/mygroup/peer1/wg-quick",
+		Storage:   s,
+	})
+	require.Nil(t, err)
+	require.Equal(t, fmt.Sprintf(`# mygroup/peer1
+
+[Interface]
+Address=10.0.0.1/24,fd00::1/64
+PrivateKey=%s
+ListenPort=51820
+
+# peer2
+[Peer]
+PublicKey=%s
+AllowedIPs=10.0.0.20/32,fd00::20/128
+`, privateKey, publicKey), res.Data["config"])
+}
+
+func TestPeersDelegatedPrefixes(t *testing.T) {
+	b, s := getTestBackend(t)
+	req := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/mygroup",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"delegation_network":       "10.244.0.0/25",
+			"delegation_prefix_length": 26,
+			"network":                  "10.0.0.0/24",
+		},
+	}
+	res, err := b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	for _, tc := range []struct {
+		data map[string]interface{}
+		err  string
+	}{
+		{
+			data: map[string]interface{}{
+				"delegation_network":       "10.9.0.0/16",
+				"delegation_prefix_length": 24,
+				"network":                  "10.9.0.0/24",
+			},
+			err: "delegation_network 10.9.0.0/16 overlaps network 10.9.0.0/24",
+		},
+		{
+			data: map[string]interface{}{
+				"delegation_network":       "10.244.0.0/16",
+				"delegation_prefix_length": 24,
+				"network":                  "10.9.0.0/24",
+			},
+			err: "delegation_network 10.244.0.0/16 overlaps delegation_network of group mygroup",
+		},
+		{
+			data: map[string]interface{}{
+				"delegation_network":       "10.245.0.0/16",
+				"delegation_prefix_length": 8,
+				"network":                  "10.9.0.0/24",
+			},
+			err: "delegation_prefix_length must be between 16 and 32",
+		},
+	} {
+		res, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      "groups/badgroup",
+			Storage:   s,
+			Data:      tc.data,
+		})
+		require.Nil(t, err)
+		require.Equal(t, tc.err, res.Error().Error())
+	}
+
+	getPrefix := func(name string) string {
+		res, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "groups/mygroup/" + name,
+			Storage:   s,
+		})
+		require.Nil(t, err)
+
+		return res.Data["delegated_prefix"].(string)
+	}
+
+	for _, name := range []string{"node1", "node2"} {
+		res, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      "groups/mygroup/" + name,
+			Storage:   s,
+			Data: map[string]interface{}{
+				"private_key": privateKey,
+			},
+		})
+		require.Nil(t, err)
+		require.Nil(t, res)
+	}
+
+	require.Equal(t, "10.244.0.0/26", getPrefix("node1"))
+	require.Equal(t, "10.244.0.64/26", getPrefix("node2"))
+
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/mygroup/node3",
+		Storage:   s,
+	})
+	require.Nil(t, err)
+	require.Equal(t, "error delegating prefix: no free prefixes left in delegation network", res.Error().Error())
+
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "groups/mygroup/node1/wg-quick",
+		Storage:   s,
+	})
+	require.Nil(t, err)
+	require.Contains(t, res.Data["config"], "AllowedIPs=10.0.0.2/32,10.244.0.64/26\n")
+
+	// Changing the prefix length re-delegates every peer
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "groups/mygroup",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"delegation_prefix_length": 27,
+		},
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+	require.Equal(t, "10.244.0.0/27", getPrefix("node1"))
+	require.Equal(t, "10.244.0.32/27", getPrefix("node2"))
+
+	// Turning delegation off removes the prefixes
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "groups/mygroup",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"delegation_network": "",
+		},
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+	require.Equal(t, "", getPrefix("node1"))
+}
+
+func TestPeersKeyDerivedAddresses(t *testing.T) {
+	b, s := getTestBackend(t)
+	req := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/mygroup",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"ipam_mode": "key",
+			"network":   "10.0.0.0/30,fd00::/64",
+		},
+	}
+	res, err := b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/badgroup",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"ipam_mode": "random",
+			"network":   "10.9.0.0/24",
+		},
+	})
+	require.Nil(t, err)
+	require.Equal(t, "unknown ipam_mode: random", res.Error().Error())
+
+	getIPs := func(name string) []string {
+		res, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "groups/mygroup/" + name,
+			Storage:   s,
+		})
+		require.Nil(t, err)
+
+		return strings.Split(res.Data["ip"].(string), ",")
+	}
+
+	// The IPv6 host bits are the last 8 bytes of SHA-256(public key)
+	derived := func(key string) string {
+		hash := sha256.Sum256([]byte(key))
+		addr := netip.MustParseAddr("fd00::").As16()
+		copy(addr[8:], hash[8:16])
+
+		return netip.AddrFrom16(addr).String()
+	}
+
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/mygroup/peer1",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"public_key": publicKey,
+		},
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+	require.Equal(t, derived(publicKey), getIPs("peer1")[1])
+
+	// The IPv4 network only has two addresses, so collisions fall back to the next free one
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/mygroup/peer2",
+		Storage:   s,
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+	require.NotEqual(t, getIPs("peer1")[0], getIPs("peer2")[0])
+	require.NotEqual(t, getIPs("peer1")[1], getIPs("peer2")[1])
+
+	// Rotating the key changes the address
+	key, err := wgtypes.GeneratePrivateKey()
+	require.Nil(t, err)
+
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "groups/mygroup/peer1",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"private_key": key.String(),
+		},
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "groups/mygroup/peer1",
+		Storage:   s,
+	})
+	require.Nil(t, err)
+	require.NotEqual(t, derived(publicKey), getIPs("peer1")[1])
+	require.Equal(t, derived(res.Data["public_key"].(string)), getIPs("peer1")[1])
+}
+
+// slowStorage widens the window between reads and writes, so concurrent requests interleave.
+type slowStorage struct {
+	logical.Storage
+}
+
+func (s slowStorage) Get(ctx context.Context, key string) (*logical.StorageEntry, error) {
+	time.Sleep(50 * time.Microsecond)
+
+	return s.Storage.Get(ctx, key)
+}
+
+func TestPeersConcurrent(t *testing.T) {
+	b, storage := getTestBackend(t)
+	s := slowStorage{
+		Storage: storage,
+	}
+	res, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/mygroup",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"network": "10.0.0.0/24",
+		},
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	const peers = 32
+
+	hammer := func(f func(i int) *logical.Request) {
+		var wg sync.WaitGroup
+
+		errs := make(chan error, peers)
+
+		for i := 0; i < peers; i++ {
+			wg.Add(1)
+
+			go func(i int) {
+				defer wg.Done()
+
+				req := f(i)
+				if req == nil {
+					return
+				}
+
+				res, err := b.HandleRequest(context.Background(), req)
+				if err == nil && res.IsError() {
+					err = res.Error()
+				}
+
+				errs <- err
+			}(i)
+		}
+
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			require.Nil(t, err)
+		}
+	}
+
+	hammer(func(i int) *logical.Request {
+		return &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      fmt.Sprintf("groups/mygroup/peer%d", i),
+			Storage:   s,
+		}
+	})
+
+	// Delete every other peer while updating the rest
+	hammer(func(i int) *logical.Request {
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      fmt.Sprintf("groups/mygroup/peer%d", i),
+			Storage:   s,
+			Data: map[string]interface{}{
+				"port": 51820,
+			},
+		}
+
+		if i%2 == 0 {
+			req.Operation = logical.DeleteOperation
+			req.Data = nil
+		}
+
+		return req
+	})
+
+	group, err := getGroup(context.Background(), s, "mygroup")
+	require.Nil(t, err)
+	require.Len(t, group.Peers, peers/2)
+
+	ips := map[string]string{}
+
+	for _, peer := range group.Peers {
+		stored, err := getPeer(context.Background(), s, "mygroup", peer.Name)
+		require.Nil(t, err)
+		require.NotNil(t, stored)
+		require.Equal(t, 51820, peer.Port)
+		require.Equal(t, stored.PublicKey, peer.PublicKey)
+		require.Equal(t, stored.IPs[0].String()+"/24", peer.IP)
+		require.NotContains(t, ips, peer.IP)
+
+		ips[peer.IP] = peer.Name
+	}
+}
+
+func TestPeersClientKey(t *testing.T) {
+	b, s := getTestBackend(t)
+	res, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/mygroup",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"network": "10.0.0.0/24",
+		},
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	write := func(name string, data map[string]interface{}) *logical.Response {
+		res, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      "groups/mygroup/" + name,
+			Storage:   s,
+			Data:      data,
+		})
+		require.Nil(t, err)
+
+		return res
+	}
+
+	read := func(path string) map[string]interface{} {
+		res, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "groups/mygroup/" + path,
+			Storage:   s,
+		})
+		require.Nil(t, err)
+
+		return res.Data
+	}
+
+	res = write("peer1", map[string]interface{}{
+		"key_policy": "client",
+	})
+	require.Equal(t, "key_policy client requires a public_key to be provided", res.Error().Error())
+
+	res = write("peer1", map[string]interface{}{
+		"key_policy":  "client",
+		"private_key": privateKey,
+	})
+	require.Equal(t, "key_policy client doesn't allow storing a private_key, provide a public_key instead", res.Error().Error())
+
+	require.Nil(t, write("peer1", map[string]interface{}{
+		"key_policy": "client",
+		"public_key": publicKey,
+	}))
+	require.Equal(t, "client", read("peer1")["key_policy"])
+	require.Equal(t, map[string]interface{}{
+		"private_key": "",
+		"public_key":  publicKey,
+	}, read("peer1/creds"))
+	require.Equal(t, `# mygroup/peer1
+
+[Interface]
+Address=10.0.0.1/24
+# The private key is held by the client, replace the placeholder with it
+PrivateKey=CLIENT_PRIVATE_KEY
+`, read("peer1/wg-quick")["config"])
+
+	// Peers that stored a key drop it when they switch to holding their own
+	require.Nil(t, write("peer2", map[string]interface{}{}))
+
+	peer2 := read("peer2")
+	require.NotEqual(t, "", read("peer2/creds")["private_key"])
+	require.Nil(t, write("peer2", map[string]interface{}{
+		"key_policy": "client",
+	}))
+	require.Equal(t, peer2["public_key"], read("peer2")["public_key"])
+	require.Equal(t, "", read("peer2/creds")["private_key"])
+
+	entry, err := s.Get(context.Background(), "creds/mygroup/peer2")
+	require.Nil(t, err)
+	require.Nil(t, entry)
+
+	// Clients can read their key from a file
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "groups/mygroup",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"key_policy":       "client",
+			"private_key_file": "/etc/wireguard/%i.key",
+		},
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	config := read("peer2/wg-quick")["config"].(string)
+	require.Contains(t, config, "\nPostUp=wg set %i private-key /etc/wireguard/%i.key\n")
+	require.NotContains(t, config, "PrivateKey=")
+
+	res = write("peer3", map[string]interface{}{})
+	require.Equal(t, "key_policy client requires a public_key to be provided", res.Error().Error())
+
+	// Client keys can't be rotated by Vault
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "groups/mygroup/peer1/rotate",
+		Storage:   s,
+	})
+	require.Nil(t, err)
+	require.True(t, res.IsError())
+}
+
+// Peers drop their stored keys when key_policy client is inherited from the group or config
+func TestPeersClientKeyInherited(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	write := func(path string, data map[string]interface{}) {
+		res, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Storage:   s,
+			Data:      data,
+		})
+		require.Nil(t, err)
+		require.Nil(t, res)
+	}
+
+	stored := func(group, name string) bool {
+		entry, err := s.Get(context.Background(), credsPath(group, name))
+		require.Nil(t, err)
+
+		return entry != nil
+	}
+
+	write("groups/group1", map[string]interface{}{
+		"network": "10.0.0.0/24",
+	})
+	write("groups/group2", map[string]interface{}{
+		"key_policy": "generate",
+		"network":    "10.0.1.0/24",
+	})
+
+	for _, path := range []string{"groups/group1/peer1", "groups/group2/peer1", "groups/group2/peer2"} {
+		write(path, map[string]interface{}{})
+	}
+
+	write("groups/group2/peer2", map[string]interface{}{
+		"key_policy": "generate",
+	})
+
+	write("config", map[string]interface{}{
+		"key_policy": "client",
+	})
+	require.False(t, stored("group1", "peer1"))
+	require.True(t, stored("group2", "peer1"))
+	require.True(t, stored("group2", "peer2"))
+
+	write("groups/group2", map[string]interface{}{
+		"inherit": "key_policy",
+	})
+	require.False(t, stored("group2", "peer1"))
+	require.True(t, stored("group2", "peer2"))
+}
+
+func TestPeersHubSpoke(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	write := func(path string, data map[string]interface{}) *logical.Response {
+		res, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Storage:   s,
+			Data:      data,
+		})
+		require.Nil(t, err)
+
+		return res
+	}
+
+	read := func(name string) string {
+		res, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "groups/mygroup/" + name + "/wg-quick",
+			Storage:   s,
+		})
+		require.Nil(t, err)
+
+		return res.Data["config"].(string)
+	}
+
+	require.Nil(t, write("groups/mygroup", map[string]interface{}{
+		"network":  "10.0.0.0/24",
+		"topology": "hub_spoke",
+	}))
+
+	res := write("groups/mygroup", map[string]interface{}{
+		"topology": "star",
+	})
+	require.Equal(t, "unknown topology: star", res.Error().Error())
+
+	require.Nil(t, write("groups/mygroup/hub1", map[string]interface{}{
+		"hub":        true,
+		"port":       51820,
+		"public_key": publicKey,
+	}))
+	require.Nil(t, write("groups/mygroup/spoke1", map[string]interface{}{
+		"public_key": publicKey,
+	}))
+	require.Nil(t, write("groups/mygroup/spoke2", map[string]interface{}{
+		"public_key": publicKey,
+	}))
+
+	require.Equal(t, fmt.Sprintf(`# mygroup/spoke1
+
+
+# hub1
+[Peer]
+PublicKey=%s
+AllowedIPs=10.0.0.1/32,10.0.0.0/24
+Endpoint=hub1:51820
+[Interface]
+Address=10.0.0.2/24
+# The private key is held by the client, replace the placeholder with it
+PrivateKey=CLIENT_PRIVATE_KEY
+`, publicKey), read("spoke1"))
+
+	config := read("hub1")
+	require.Contains(t, config, "# spoke1\n[Peer]\nPublicKey="+publicKey+"\nAllowedIPs=10.0.0.2/32\n")
+	require.Contains(t, config, "# spoke2\n[Peer]\nPublicKey="+publicKey+"\nAllowedIPs=10.0.0.3/32\n")
+
+	// Only the first hub routes the group network
+	require.Nil(t, write("groups/mygroup/hub2", map[string]interface{}{
+		"hub":        true,
+		"port":       51820,
+		"public_key": publicKey,
+	}))
+
+	config = read("spoke2")
+	require.Contains(t, config, "# hub1\n[Peer]\nPublicKey="+publicKey+"\nAllowedIPs=10.0.0.1/32,10.0.0.0/24\n")
+	require.Contains(t, config, "# hub2\n[Peer]\nPublicKey="+publicKey+"\nAllowedIPs=10.0.0.4/32\n")
+	require.NotContains(t, config, "# spoke1")
+	require.Contains(t, read("hub2"), "# hub1\n")
+
+	require.Nil(t, write("groups/mygroup", map[string]interface{}{
+		"topology": "full_mesh",
+	}))
+
+	config = read("spoke2")
+	require.Contains(t, config, "# spoke1\n")
+	require.Contains(t, config, "AllowedIPs=10.0.0.1/32\n")
+}
+
+func TestPeersRelay(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	write := func(path string, data map[string]interface{}) *logical.Response {
+		res, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Storage:   s,
+			Data:      data,
+		})
+		require.Nil(t, err)
+
+		return res
+	}
+
+	read := func(name string) string {
+		res, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "groups/mygroup/" + name + "/wg-quick",
+			Storage:   s,
+		})
+		require.Nil(t, err)
+
+		return res.Data["config"].(string)
+	}
+
+	require.Nil(t, write("groups/mygroup", map[string]interface{}{
+		"network": "10.0.0.0/24",
+	}))
+
+	for _, name := range []string{"laptop1", "laptop2"} {
+		require.Nil(t, write("groups/mygroup/"+name, map[string]interface{}{
+			"public_key": publicKey,
+		}))
+	}
+
+	// Without a relay, peers without a port are still rendered
+	require.Contains(t, read("laptop1"), "# laptop2\n")
+
+	res := write("groups/mygroup/relay1", map[string]interface{}{
+		"public_key": publicKey,
+		"relay":      true,
+	})
+	require.Equal(t, "relay peers need a port", res.Error().Error())
+
+	require.Nil(t, write("groups/mygroup/relay1", map[string]interface{}{
+		"port":       51820,
+		"public_key": publicKey,
+		"relay":      true,
+	}))
+	require.Nil(t, write("groups/mygroup/server1", map[string]interface{}{
+		"port":       51820,
+		"public_key": publicKey,
+	}))
+
+	config := read("laptop1")
+	require.NotContains(t, config, "# laptop2\n")
+	require.Contains(t, config, "# relay1\n[Peer]\nPublicKey="+publicKey+"\nAllowedIPs=10.0.0.3/32,10.0.0.2/32\nEndpoint=relay1:51820\n")
+	require.Contains(t, config, "# server1\n[Peer]\nPublicKey="+publicKey+"\nAllowedIPs=10.0.0.4/32\nEndpoint=server1:51820\n")
+	require.NotContains(t, config, "PostUp=")
+
+	config = read("relay1")
+	require.Contains(t, config, "\nPostUp=sysctl -w net.ipv4.ip_forward=1\n")
+	require.Contains(t, config, "# laptop1\n[Peer]\nPublicKey="+publicKey+"\nAllowedIPs=10.0.0.1/32\n")
+	require.Contains(t, config, "# laptop2\n[Peer]\nPublicKey="+publicKey+"\nAllowedIPs=10.0.0.2/32\n")
+
+	config = read("server1")
+	require.Contains(t, config, "# laptop1\n")
+	require.Contains(t, config, "# laptop2\n")
+	require.NotContains(t, config, "PostUp=")
+
+	// Peers are only relayed through relays both can reach
+	require.Nil(t, write("groups/mygroup", map[string]interface{}{
+		"access_rules": "deny laptop2 relay1",
+	}))
+
+	config = read("laptop1")
+	require.Contains(t, config, "# laptop2\n")
+	require.Contains(t, config, "AllowedIPs=10.0.0.3/32\n")
+}
+
+func TestPeersEndpoints(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	write := func(path string, data map[string]interface{}) *logical.Response {
+		res, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Storage:   s,
+			Data:      data,
+		})
+		require.Nil(t, err)
+
+		return res
+	}
+
+	read := func(path string) map[string]interface{} {
+		res, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "groups/mygroup/" + path,
+			Storage:   s,
+		})
+		require.Nil(t, err)
+
+		return res.Data
+	}
+
+	require.Nil(t, write("groups/mygroup", map[string]interface{}{
+		"network": "10.0.0.0/24",
+	}))
+
+	res := write("groups/mygroup/server1", map[string]interface{}{
+		"endpoints": "fd00::1:51820",
+	})
+	require.Equal(t, "error parsing endpoints: address fd00::1:51820: too many colons in address", res.Error().Error())
+
+	res = write("groups/mygroup/server1", map[string]interface{}{
+		"endpoints": "office=192.168.1.10:0",
+	})
+	require.Equal(t, "error parsing endpoints: invalid port in endpoint 192.168.1.10:0", res.Error().Error())
+
+	require.Nil(t, write("groups/mygroup/server1", map[string]interface{}{
+		"endpoints": "Office=192.168.1.10:51820,vpn.example.com:51821",
+		"port":      51820,
+		"site":      "office",
+	}))
+	require.Nil(t, write("groups/mygroup/server2", map[string]interface{}{
+		"hostname": "fd00::1",
+		"port":     51820,
+	}))
+	require.Nil(t, write("groups/mygroup/server3", map[string]interface{}{
+		"endpoints": "[2001:db8::1]:51820",
+	}))
+	require.Nil(t, write("groups/mygroup/laptop1", map[string]interface{}{
+		"site": "office",
+	}))
+	require.Nil(t, write("groups/mygroup/laptop2", map[string]interface{}{
+		"site": "home",
+	}))
+
+	server1 := read("server1")
+	require.Equal(t, []string{"office=192.168.1.10:51820", "vpn.example.com:51821"}, server1["endpoints"])
+	require.Equal(t, "office", server1["site"])
+
+	config := read("laptop1/wg-quick")["config"].(string)
+	require.Contains(t, config, "\nEndpoint=192.168.1.10:51820\n")
+	require.Contains(t, config, "\nEndpoint=[fd00::1]:51820\n")
+	require.Contains(t, config, "\nEndpoint=[2001:db8::1]:51820\n")
+
+	config = read("laptop2/wg-quick")["config"].(string)
+	require.Contains(t, config, "\nEndpoint=vpn.example.com:51821\n")
+	require.NotContains(t, config, "192.168.1.10")
+
+	// Peers fall back to the hostname and port without public endpoints
+	require.Nil(t, write("groups/mygroup/server1", map[string]interface{}{
+		"endpoints": "office=192.168.1.10:51820",
+	}))
+	require.Contains(t, read("laptop2/wg-quick")["config"], "\nEndpoint=server1:51820\n")
+}
+
+func TestPeersExitNode(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	write := func(path string, data map[string]interface{}) *logical.Response {
+		res, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Storage:   s,
+			Data:      data,
+		})
+		require.Nil(t, err)
+
+		return res
+	}
+
+	read := func(name string) *logical.Response {
+		res, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "groups/mygroup/" + name + "/wg-quick",
+			Storage:   s,
+		})
+		require.Nil(t, err)
+
+		return res
+	}
+
+	require.Nil(t, write("groups/mygroup", map[string]interface{}{
+		"network": "10.0.0.0/24,fd00::/64",
+	}))
+
+	res := write("groups/mygroup/laptop1", map[string]interface{}{
+		"tunnel": "most",
+	})
+	require.Equal(t, "unknown tunnel: most", res.Error().Error())
+
+	res = write("groups/mygroup/laptop1", map[string]interface{}{
+		"table": "main",
+	})
+	require.Equal(t, "table must be auto, off or a routing table number: main", res.Error().Error())
+
+	require.Nil(t, write("groups/mygroup/laptop1", map[string]interface{}{
+		"public_key": publicKey,
+		"table":      "1234",
+		"tunnel":     "full",
+	}))
+	require.Equal(t, "peer laptop1 uses a full tunnel, but can't reach an exit node", read("laptop1").Error().Error())
+
+	res = write("groups/mygroup/exit1", map[string]interface{}{
+		"exit_node":  true,
+		"public_key": publicKey,
+	})
+	require.Equal(t, "exit nodes need a port", res.Error().Error())
+
+	require.Nil(t, write("groups/mygroup/exit1", map[string]interface{}{
+		"exit_node":  true,
+		"port":       51820,
+		"public_key": publicKey,
+	}))
+	require.Nil(t, write("groups/mygroup/laptop2", map[string]interface{}{
+		"public_key": publicKey,
+	}))
+
+	config := read("laptop1").Data["config"].(string)
+	require.Contains(t, config, "\nTable=1234\n# Set dns for this peer, or DNS queries won't go through the exit node\n")
+	require.Contains(t, config, "# exit1\n[Peer]\nPublicKey="+publicKey+"\nAllowedIPs=10.0.0.2/32,fd00::2/128,0.0.0.0/0,::/0\nEndpoint=exit1:51820\n")
+
+	// Split tunnel peers only route the group through the exit node
+	config = read("laptop2").Data["config"].(string)
+	require.Contains(t, config, "# exit1\n[Peer]\nPublicKey="+publicKey+"\nAllowedIPs=10.0.0.2/32,fd00::2/128\n")
+	require.NotContains(t, config, "0.0.0.0/0")
+	require.NotContains(t, config, "Table=")
+
+	require.Equal(t, `# mygroup/exit1
+
+[Interface]
+Address=10.0.0.2/24,fd00::2/64
+# The private key is held by the client, replace the placeholder with it
+PrivateKey=CLIENT_PRIVATE_KEY
+PostUp=sysctl -w net.ipv4.ip_forward=1
+PostUp=sysctl -w net.ipv6.conf.all.forwarding=1
+PostUp=iptables -A FORWARD -i %i -o %i -j DROP
+PostUp=iptables -A FORWARD -i %i ! -o %i -j ACCEPT
+PostUp=iptables -A FORWARD -o %i -m state --state RELATED,ESTABLISHED -j ACCEPT
+PostUp=iptables -A POSTROUTING -t nat -s 10.0.0.0/24 ! -o %i -j MASQUERADE
+PostUp=ip6tables -A FORWARD -i %i -o %i -j DROP
+PostUp=ip6tables -A FORWARD -i %i ! -o %i -j ACCEPT
+PostUp=ip6tables -A FORWARD -o %i -m state --state RELATED,ESTABLISHED -j ACCEPT
+PostUp=ip6tables -A POSTROUTING -t nat -s fd00::/64 ! -o %i -j MASQUERADE
+PostDown=iptables -D FORWARD -i %i -o %i -j DROP
+PostDown=iptables -D FORWARD -i %i ! -o %i -j ACCEPT
+PostDown=iptables -D FORWARD -o %i -m state --state RELATED,ESTABLISHED -j ACCEPT
+PostDown=iptables -D POSTROUTING -t nat -s 10.0.0.0/24 ! -o %i -j MASQUERADE
+PostDown=ip6tables -D FORWARD -i %i -o %i -j DROP
+PostDown=ip6tables -D FORWARD -i %i ! -o %i -j ACCEPT
+PostDown=ip6tables -D FORWARD -o %i -m state --state RELATED,ESTABLISHED -j ACCEPT
+PostDown=ip6tables -D POSTROUTING -t nat -s fd00::/64 ! -o %i -j MASQUERADE
+ListenPort=51820
+
+# laptop1
+[Peer]
+PublicKey=`+publicKey+`
+AllowedIPs=10.0.0.1/32,fd00::1/128
+
+# laptop2
+[Peer]
+PublicKey=`+publicKey+`
+AllowedIPs=10.0.0.3/32,fd00::3/128
+`, read("exit1").Data["config"])
+
+	require.Nil(t, write("groups/mygroup/laptop1", map[string]interface{}{
+		"dns": "10.0.0.2",
+	}))
+
+	config = read("laptop1").Data["config"].(string)
+	require.Contains(t, config, "\nDNS=10.0.0.2\n")
+	require.NotContains(t, config, "# Set dns")
+
+	// Exit nodes that relay still forward between peers
+	require.Nil(t, write("groups/mygroup/exit1", map[string]interface{}{
+		"relay": true,
+	}))
+
+	config = read("exit1").Data["config"].(string)
+	require.Contains(t, config, "\nPostUp=iptables -A FORWARD -i %i ! -o %i -j ACCEPT\n")
+	require.NotContains(t, config, "DROP")
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	presharedKeysGroup = "group"
+	presharedKeysNone  = "none"
+	presharedKeysPair  = "pair"
+)
+
+type wireguardGroupPSK struct {
+	PresharedKey string `json:"preshared_key"`
+}
+
+func generatePSK() (string, error) {
+	key, err := wgtypes.GenerateKey()
+	if err != nil {
+		return "", fmt.Errorf("error generating preshared key: %w", err)
+	}
+
+	return key.String(), nil
+}
+
+func validatePresharedKeys(presharedKeys string) error {
+	switch presharedKeys {
+	case "":
+	case presharedKeysGroup:
+	case presharedKeysNone:
+	case presharedKeysPair:
+	default:
+		return fmt.Errorf("unknown preshared_keys: %s", presharedKeys)
+	}
+
+	return nil
+}
+
+func getGroupPSK(ctx context.Context, s logical.Storage, name string) (string, error) {
+	entry, err := s.Get(ctx, "psk/"+name)
+	if err != nil {
+		return "", fmt.Errorf("error retrieving group preshared key: %w", err)
+	}
+
+	if entry == nil {
+		return "", nil
+	}
+
+	var psk wireguardGroupPSK
+
+	if err := entry.DecodeJSON(&psk); err != nil {
+		return "", fmt.Errorf("error decoding group preshared key: %w", err)
+	}
+
+	return psk.PresharedKey, nil
+}
+
+// updateGroupPSK creates or removes the group preshared key depending on the mode.  If rotate is set, a new key is always generated.
+func (b *wireguardBackend) updateGroupPSK(ctx context.Context, s logical.Storage, name, mode string, rotate bool) error {
+	psk, err := getGroupPSK(ctx, s, name)
+	if err != nil {
+		return err
+	}
+
+	if mode != presharedKeysGroup {
+		if psk != "" {
+			return b.delete(ctx, s, "psk/"+name)
+		}
+
+		return nil
+	}
+
+	if psk != "" && !rotate {
+		return nil
+	}
+
+	psk, err = generatePSK()
+	if err != nil {
+		return err
+	}
+
+	return b.put(ctx, s, "psk/"+name, wireguardGroupPSK{
+		PresharedKey: psk,
+	})
+}
+
+// updatePairPSKs makes sure every pair of peers shares a preshared key if enabled, otherwise removes them.  Pairs for which rotate returns true get a new key.  Returns which peers were changed.
+func updatePairPSKs(peers []*wireguardPeer, enabled bool, rotate func(a, b string) bool) ([]bool, error) {
+	changed := make([]bool, len(peers))
+	names := map[string]bool{}
+
+	for _, p := range peers {
+		names[p.Name] = true
+	}
+
+	for i, p := range peers {
+		for name := range p.PresharedKeys {
+			if !enabled || !names[name] {
+				delete(p.PresharedKeys, name)
+				changed[i] = true
+			}
+		}
+	}
+
+	if !enabled {
+		return changed, nil
+	}
+
+	for i := range peers {
+		for j := i + 1; j < len(peers); j++ {
+			a := peers[i]
+			b := peers[j]
+
+			if a.PresharedKeys[b.Name] != "" && a.PresharedKeys[b.Name] == b.PresharedKeys[a.Name] && (rotate == nil || !rotate(a.Name, b.Name)) {
+				continue
+			}
+
+			psk, err := generatePSK()
+			if err != nil {
+				return nil, err
+			}
+
+			if a.PresharedKeys == nil {
+				a.PresharedKeys = map[string]string{}
+			}
+
+			if b.PresharedKeys == nil {
+				b.PresharedKeys = map[string]string{}
+			}
+
+			a.PresharedKeys[b.Name] = psk
+			b.PresharedKeys[a.Name] = psk
+			changed[i] = true
+			changed[j] = true
+		}
+	}
+
+	return changed, nil
+}
+
+func (b *wireguardBackend) pathPSKRotateWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+
+	lock := b.groupLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	group, err := b.getGroup(ctx, req.Storage, name)
+	if err != nil || group == nil {
+		return logical.ErrorResponse("missing group"), err
+	}
+
+	if _, err := applyPendingPeers(ctx, req.Storage, group); err != nil {
+		return nil, err
+	}
+
+	config, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	peerNames := data.Get("peers").([]string)
+	if len(peerNames) > 2 {
+		return logical.ErrorResponse("peers can contain at most two peers"), nil
+	}
+
+	for _, peerName := range peerNames {
+		found := false
+
+		for _, peer := range group.Peers {
+			found = found || peer.Name == peerName
+		}
+
+		if !found {
+			return logical.ErrorResponse(fmt.Sprintf("missing peer %s", peerName)), nil
+		}
+	}
+
+	switch resolveSettings(config.settingsLayer(), group.settingsLayer()).string("preshared_keys") {
+	case presharedKeysGroup:
+		if len(peerNames) > 0 {
+			return logical.ErrorResponse("group uses a single preshared key, rotate it without peers"), nil
+		}
+
+		return nil, b.updateGroupPSK(ctx, req.Storage, name, presharedKeysGroup, true)
+	case presharedKeysPair:
+		return b.updateGroupPeers(ctx, req.Storage, group, func(a, b string) bool {
+			for _, peerName := range peerNames {
+				if peerName != a && peerName != b {
+					return false
+				}
+			}
+
+			return true
+		})
+	}
+
+	return logical.ErrorResponse("group doesn't use preshared keys"), nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+var pskRegexp = regexp.MustCompile(`# (\S+)\n\[Peer\]\nPublicKey=\S+\nPresharedKey=(\S+)`)
+
+func TestPSK(t *testing.T) {
+	b, s := getTestBackend(t)
+	req := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/mygroup",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"network":        "10.0.0.0/24",
+			"preshared_keys": "pair",
+		},
+	}
+	res, err := b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	names := []string{"peer1", "peer2", "peer3"}
+
+	for _, name := range names {
+		res, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      "groups/mygroup/" + name,
+			Storage:   s,
+		})
+		require.Nil(t, err)
+		require.Nil(t, res)
+	}
+
+	// getPSKs returns the preshared keys of each pair, keyed by the peer names
+	getPSKs := func() map[string]string {
+		psks := map[string]string{}
+
+		for _, name := range names {
+			res, err := b.HandleRequest(context.Background(), &logical.Request{
+				Operation: logical.ReadOperation,
+				Path:      "groups/mygroup/" + name + "/wg-quick",
+				Storage:   s,
+			})
+			require.Nil(t, err)
+
+			for _, match := range pskRegexp.FindAllStringSubmatch(res.Data["config"].(string), -1) {
+				pair := name + "-" + match[1]
+				if match[1] < name {
+					pair = match[1] + "-" + name
+				}
+
+				if psk, ok := psks[pair]; ok {
+					require.Equal(t, psk, match[2])
+				}
+
+				psks[pair] = match[2]
+			}
+		}
+
+		return psks
+	}
+
+	rotate := func(peers string) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "rotate-psk/mygroup",
+			Storage:   s,
+			Data: map[string]interface{}{
+				"peers": peers,
+			},
+		})
+	}
+
+	psks := getPSKs()
+	require.Len(t, psks, 3)
+	require.NotEqual(t, psks["peer1-peer2"], psks["peer1-peer3"])
+	require.NotEqual(t, psks["peer1-peer2"], psks["peer2-peer3"])
+
+	// Keys survive unrelated writes
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "groups/mygroup/peer2",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"hostname": "peer2",
+		},
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+	require.Equal(t, psks, getPSKs())
+
+	// Read doesn't return keys
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "groups/mygroup/peer1",
+		Storage:   s,
+	})
+	require.Nil(t, err)
+	require.NotContains(t, res.Data, "preshared_keys")
+
+	// Rotate pair
+	res, err = rotate("peer1,peer2")
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	rotated := getPSKs()
+	require.NotEqual(t, psks["peer1-peer2"], rotated["peer1-peer2"])
+	require.Equal(t, psks["peer1-peer3"], rotated["peer1-peer3"])
+	require.Equal(t, psks["peer2-peer3"], rotated["peer2-peer3"])
+
+	// Rotate peer
+	psks = rotated
+	res, err = rotate("peer3")
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	rotated = getPSKs()
+	require.Equal(t, psks["peer1-peer2"], rotated["peer1-peer2"])
+	require.NotEqual(t, psks["peer1-peer3"], rotated["peer1-peer3"])
+	require.NotEqual(t, psks["peer2-peer3"], rotated["peer2-peer3"])
+
+	// Rotate group
+	psks = rotated
+	res, err = rotate("")
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	rotated = getPSKs()
+	for pair := range psks {
+		require.NotEqual(t, psks[pair], rotated[pair])
+	}
+
+	// Bad peers
+	res, err = rotate("peer4")
+	require.Nil(t, err)
+	require.Equal(t, "missing peer peer4", res.Data["error"])
+
+	res, err = rotate("peer1,peer2,peer3")
+	require.Nil(t, err)
+	require.Equal(t, "peers can contain at most two peers", res.Data["error"])
+
+	// Deleted peers lose their keys
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      "groups/mygroup/peer3",
+		Storage:   s,
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	names = names[:2]
+	peer, err := getPeer(context.Background(), s, "mygroup", "peer1")
+	require.Nil(t, err)
+	require.Equal(t, map[string]string{
+		"peer2": rotated["peer1-peer2"],
+	}, peer.PresharedKeys)
+
+	// Group key
+	req.Operation = logical.UpdateOperation
+	req.Data = map[string]interface{}{
+		"preshared_keys": "group",
+	}
+	res, err = b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	peer, err = getPeer(context.Background(), s, "mygroup", "peer1")
+	require.Nil(t, err)
+	require.Empty(t, peer.PresharedKeys)
+
+	psks = getPSKs()
+	psk, err := getGroupPSK(context.Background(), s, "mygroup")
+	require.Nil(t, err)
+	require.NotEqual(t, "", psk)
+	require.Equal(t, map[string]string{
+		"peer1-peer2": psk,
+	}, psks)
+
+	res, err = rotate("peer1")
+	require.Nil(t, err)
+	require.Equal(t, "group uses a single preshared key, rotate it without peers", res.Data["error"])
+
+	res, err = rotate("")
+	require.Nil(t, err)
+	require.Nil(t, res)
+	require.NotEqual(t, psks, getPSKs())
+
+	// Disable
+	req.Data = map[string]interface{}{
+		"preshared_keys": "none",
+	}
+	res, err = b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Nil(t, res)
+	require.Empty(t, getPSKs())
+
+	psk, err = getGroupPSK(context.Background(), s, "mygroup")
+	require.Nil(t, err)
+	require.Equal(t, "", psk)
+
+	res, err = rotate("")
+	require.Nil(t, err)
+	require.Equal(t, "group doesn't use preshared keys", res.Data["error"])
+
+	// Groups inheriting preshared_keys get keys when the config changes
+	writeConfig := func(presharedKeys string) {
+		res, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "config",
+			Storage:   s,
+			Data: map[string]interface{}{
+				"preshared_keys": presharedKeys,
+			},
+		})
+		require.Nil(t, err)
+		require.Nil(t, res)
+	}
+
+	req.Data = map[string]interface{}{
+		"inherit": "preshared_keys",
+	}
+	res, err = b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	writeConfig("pair")
+	psks = getPSKs()
+	require.Len(t, psks, 1)
+	require.NotEqual(t, "", psks["peer1-peer2"])
+
+	writeConfig("group")
+	psk, err = getGroupPSK(context.Background(), s, "mygroup")
+	require.Nil(t, err)
+	require.NotEqual(t, "", psk)
+	require.Equal(t, map[string]string{
+		"peer1-peer2": psk,
+	}, getPSKs())
+
+	writeConfig("none")
+	require.Empty(t, getPSKs())
+
+	wals, err := framework.ListWAL(context.Background(), s)
+	require.Nil(t, err)
+	require.Empty(t, wals)
+
+	// Bad mode
+	req.Data = map[string]interface{}{
+		"preshared_keys": "bad",
+	}
+	res, err = b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Equal(t, "unknown preshared_keys: bad", res.Data["error"])
+}
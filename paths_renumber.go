@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+type renumberPlan struct {
+	Conflicts []map[string]interface{}
+	IPs       map[string][]netip.Addr
+	Peers     []map[string]interface{}
+}
+
+// planRenumber maps the peer addresses of a group to the new networks.  Addresses keep their offset within the network if possible, otherwise a new address is allocated.  During a transition the current addresses stay in use, the same as when the renumber is applied.
+func planRenumber(group *wireguardGroup, networks []netip.Prefix, routes []ownedPrefix, transition bool) (*renumberPlan, error) {
+	plan := &renumberPlan{
+		Conflicts: []map[string]interface{}{},
+		IPs:       map[string][]netip.Addr{},
+		Peers:     []map[string]interface{}{},
+	}
+
+	current := groupIPs(group)
+	used := ipSet{}
+
+	if transition {
+		for _, peer := range group.Peers {
+			for _, network := range group.Networks {
+				if ip := addrIn(network, current[peer.Name]); ip.IsValid() {
+					used.add(ip)
+				}
+			}
+		}
+	}
+
+	for _, peer := range group.Peers {
+		ips := []netip.Addr{}
+
+		for _, to := range networks {
+			for _, from := range group.Networks {
+				ip := renumberIP(addrIn(from, current[peer.Name]), from, to)
+				if isHostAddr(to, ip) && !used.has(ip) && !prefixesContain(group.ReservedRanges, ip) {
+					ips = append(ips, ip)
+					used.add(ip)
+
+					break
+				}
+			}
+		}
+
+		plan.IPs[peer.Name] = ips
+	}
+
+	for _, peer := range group.Peers {
+		ips, err := allocateIPs(networks, plan.IPs[peer.Name], used, group.ReservedRanges, group.ipamKey(&wireguardPeer{
+			PublicKey: peer.PublicKey,
+		}))
+		if err != nil {
+			return nil, fmt.Errorf("error allocating address for peer %s: %w", peer.Name, err)
+		}
+
+		old := []netip.Addr{}
+
+		for _, network := range group.Networks {
+			if ip := addrIn(network, current[peer.Name]); ip.IsValid() {
+				old = append(old, ip)
+			}
+		}
+
+		plan.IPs[peer.Name] = ips
+		plan.Peers = append(plan.Peers, map[string]interface{}{
+			"name":   peer.Name,
+			"old_ip": joinAddrs(old),
+			"new_ip": joinAddrs(ips),
+		})
+	}
+
+	for _, route := range routes {
+		for _, network := range networks {
+			if route.Prefix.Overlaps(network) {
+				plan.Conflicts = append(plan.Conflicts, map[string]interface{}{
+					"allowed_ips": route.Prefix.String(),
+					"network":     network.String(),
+					"peer":        route.Peer,
+				})
+			}
+		}
+	}
+
+	return plan, nil
+}
+
+func (b *wireguardBackend) pathRenumberWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+
+	b.configLock.Lock()
+	defer b.configLock.Unlock()
+
+	lock := b.groupLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	group, err := b.getGroup(ctx, req.Storage, name)
+	if err != nil || group == nil {
+		return logical.ErrorResponse("missing group"), err
+	}
+
+	if _, err := applyPendingPeers(ctx, req.Storage, group); err != nil {
+		return nil, err
+	}
+
+	networks, routes, err := addressSpaceUsage(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	confirm := data.Get("confirm").(bool)
+	transition := data.Get("transition").(bool)
+
+	// The new networks can't reuse the networks the group has now or keeps from a transition
+	taken := networks
+
+	for _, network := range append(group.Networks, group.PreviousNetworks...) {
+		taken = append(taken, ownedPrefix{
+			Owner:  "network of group " + name,
+			Prefix: network,
+		})
+	}
+
+	values, err := b.parseGroupNetworks(ctx, req.Storage, data.Get("network").([]string), nil, append(taken, routes...), confirm)
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("error allocating network: %s", err)), nil
+	}
+
+	newNetworks, err := parseNetworks(values)
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("error parsing network: %s", err)), nil
+	}
+
+	for _, network := range newNetworks {
+		if overlap := findOverlap(network, taken); overlap != nil {
+			return logical.ErrorResponse(fmt.Sprintf("network %s overlaps %s", network, overlap.Owner)), nil
+		}
+	}
+
+	plan, err := planRenumber(group, newNetworks, routes, transition)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	res := &logical.Response{
+		Data: map[string]interface{}{
+			"applied":   false,
+			"conflicts": plan.Conflicts,
+			"network":   joinPrefixes(newNetworks),
+			"peers":     plan.Peers,
+		},
+	}
+
+	if !confirm {
+		space, err := getAddressSpace(ctx, req.Storage)
+		if err != nil {
+			return nil, err
+		}
+
+		// A dry run doesn't save the ULA network it allocated from, so applying allocates from another one
+		for i, value := range data.Get("network").([]string) {
+			if network := newNetworks[i]; strings.HasPrefix(value, "/") && !prefixWithin(network, space.Networks) {
+				res.AddWarning(fmt.Sprintf("network %s is allocated from a generated ULA network that is only saved to the address space when the renumber is applied", network))
+			}
+		}
+
+		return res, nil
+	}
+
+	if len(plan.Conflicts) > 0 {
+		res.AddWarning("not applying renumber because of conflicts with allowed_ips")
+
+		return res, nil
+	}
+
+	entry := &renumberWAL{
+		From:       group.Networks,
+		Group:      name,
+		IPs:        plan.IPs,
+		Networks:   newNetworks,
+		Transition: transition,
+	}
+
+	return withWAL(ctx, req.Storage, walKindRenumber, entry, func() (*logical.Response, error) {
+		if r, err := b.applyRenumber(ctx, req.Storage, group, entry); r != nil || err != nil {
+			return r, err
+		}
+
+		res.Data["applied"] = true
+
+		return res, nil
+	})
+}
+
+// applyRenumber moves the group and its peers to the new networks.  The peers keep their current addresses as previous addresses during a transition.
+func (b *wireguardBackend) applyRenumber(ctx context.Context, s logical.Storage, group *wireguardGroup, entry *renumberWAL) (*logical.Response, error) {
+	current := groupIPs(group)
+
+	for _, p := range group.Peers {
+		peer, err := getPeer(ctx, s, group.Name, p.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		if peer == nil {
+			continue
+		}
+
+		peer.PreviousIPs = nil
+
+		if entry.Transition {
+			for _, network := range group.Networks {
+				if ip := addrIn(network, current[p.Name]); ip.IsValid() {
+					peer.PreviousIPs = append(peer.PreviousIPs, ip)
+				}
+			}
+		}
+
+		peer.IPs = entry.IPs[p.Name]
+
+		if err := b.putPeer(ctx, s, group.Name, p.Name, peer); err != nil {
+			return nil, err
+		}
+	}
+
+	group.PreviousNetworks = nil
+
+	if entry.Transition {
+		group.PreviousNetworks = group.Networks
+	}
+
+	group.Networks = entry.Networks
+
+	return b.updateGroupPeers(ctx, s, group, nil)
+}
+
+func (b *wireguardBackend) pathRenumberDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+
+	lock := b.groupLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	group, err := b.getGroup(ctx, req.Storage, name)
+	if err != nil || group == nil {
+		return logical.ErrorResponse("missing group"), err
+	}
+
+	group.PreviousNetworks = nil
+
+	return b.updateGroupPeers(ctx, req.Storage, group, nil)
+}
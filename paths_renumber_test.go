@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenumber(t *testing.T) {
+	b, s := getTestBackend(t)
+	req := &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/mygroup",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"network": "10.0.0.0/24",
+		},
+	}
+	b.HandleRequest(context.Background(), req)
+
+	for name, data := range map[string]map[string]interface{}{
+		"peer1": {
+			"ip": "10.0.0.10",
+		},
+		"peer2": {
+			"allowed_ips": "10.3.0.0/24",
+			"ip":          "10.0.0.200",
+		},
+		"peer3": {},
+	} {
+		res, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      "groups/mygroup/" + name,
+			Storage:   s,
+			Data:      data,
+		})
+		require.Nil(t, err)
+		require.Nil(t, res)
+	}
+
+	getIP := func(name string) (string, string) {
+		res, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "groups/mygroup/" + name,
+			Storage:   s,
+		})
+		require.Nil(t, err)
+
+		return res.Data["ip"].(string), res.Data["previous_ip"].(string)
+	}
+
+	// Plan
+	req = &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "renumber/mygroup",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"network": "10.1.0.0/25",
+		},
+	}
+
+	res, err := b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Equal(t, map[string]interface{}{
+		"applied":   false,
+		"conflicts": []map[string]interface{}{},
+		"network":   "10.1.0.0/25",
+		"peers": []map[string]interface{}{
+			{
+				"name":   "peer1",
+				"new_ip": "10.1.0.10",
+				"old_ip": "10.0.0.10",
+			},
+			{
+				"name":   "peer2",
+				"new_ip": "10.1.0.2",
+				"old_ip": "10.0.0.200",
+			},
+			{
+				"name":   "peer3",
+				"new_ip": "10.1.0.1",
+				"old_ip": "10.0.0.1",
+			},
+		},
+	}, res.Data)
+
+	ip, _ := getIP("peer1")
+	require.Equal(t, "10.0.0.10", ip)
+
+	// Conflicts aren't applied
+	req.Data["network"] = "10.3.0.0/16"
+	req.Data["confirm"] = true
+
+	res, err = b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Equal(t, false, res.Data["applied"])
+	require.Equal(t, []map[string]interface{}{
+		{
+			"allowed_ips": "10.3.0.0/24",
+			"network":     "10.3.0.0/16",
+			"peer":        "mygroup/peer2",
+		},
+	}, res.Data["conflicts"])
+	require.Len(t, res.Warnings, 1)
+
+	// Apply with a transition
+	req.Data["network"] = "10.1.0.0/25"
+	req.Data["transition"] = true
+
+	res, err = b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Equal(t, true, res.Data["applied"])
+
+	ip, previous := getIP("peer2")
+	require.Equal(t, "10.1.0.2", ip)
+	require.Equal(t, "10.0.0.200", previous)
+
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "groups/mygroup/peer1/wg-quick",
+		Storage:   s,
+	})
+	require.Nil(t, err)
+	require.Contains(t, res.Data["config"], "Address=10.1.0.10/25,10.0.0.10/24\n")
+	require.Contains(t, res.Data["config"], "AllowedIPs=10.1.0.2/32,10.0.0.200/32,10.3.0.0/24\n")
+
+	// New peers don't get addresses used by the transition
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/mygroup/peer4",
+		Storage:   s,
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	ip, previous = getIP("peer4")
+	require.Equal(t, "10.1.0.3", ip)
+	require.Equal(t, "", previous)
+
+	// Other groups can't use the previous network until the transition is finished
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/othergroup",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"network": "10.0.0.0/24",
+		},
+	})
+	require.Nil(t, err)
+	require.Equal(t, "network 10.0.0.0/24 overlaps previous network of group mygroup", res.Error().Error())
+
+	// Finish the transition
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      "renumber/mygroup",
+		Storage:   s,
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	ip, previous = getIP("peer2")
+	require.Equal(t, "10.1.0.2", ip)
+	require.Equal(t, "", previous)
+
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "groups/mygroup",
+		Storage:   s,
+	})
+	require.Nil(t, err)
+	require.Equal(t, "10.1.0.0/25", res.Data["network"])
+	require.Equal(t, "", res.Data["previous_network"])
+}
+
+func TestRenumberAllocate(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	res, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/mygroup",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"network": "10.0.0.0/24",
+		},
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	for _, name := range []string{"peer1", "peer2", "peer3"} {
+		res, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      "groups/mygroup/" + name,
+			Storage:   s,
+		})
+		require.Nil(t, err)
+		require.Nil(t, res)
+	}
+
+	// Dry runs don't save the generated ULA network
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "renumber/mygroup",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"network": []string{"10.1.0.0/24", "/64"},
+		},
+	}
+
+	res, err = b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Equal(t, false, res.Data["applied"])
+	require.Len(t, res.Warnings, 1)
+
+	entry, err := s.Get(context.Background(), "config/address_space")
+	require.Nil(t, err)
+	require.Nil(t, entry)
+
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config/address_space",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"networks": "10.0.0.0/16",
+		},
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	// The current network can't be reused
+	req.Data = map[string]interface{}{
+		"network": "10.0.0.0/25",
+	}
+
+	res, err = b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Equal(t, "network 10.0.0.0/25 overlaps network of group mygroup", res.Error().Error())
+
+	// The applied addresses match the plan
+	req.Data = map[string]interface{}{
+		"network":    "/24",
+		"transition": true,
+	}
+
+	plan, err := b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Equal(t, "10.0.1.0/24", plan.Data["network"])
+
+	req.Data["confirm"] = true
+
+	res, err = b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Equal(t, true, res.Data["applied"])
+	require.Equal(t, plan.Data["network"], res.Data["network"])
+	require.Equal(t, plan.Data["peers"], res.Data["peers"])
+
+	for _, peer := range res.Data["peers"].([]map[string]interface{}) {
+		res, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "groups/mygroup/" + peer["name"].(string),
+			Storage:   s,
+		})
+		require.Nil(t, err)
+		require.Equal(t, peer["new_ip"], res.Data["ip"])
+		require.Equal(t, peer["old_ip"], res.Data["previous_ip"])
+	}
+
+	// Neither the current nor the previous network is allocated again
+	req.Data = map[string]interface{}{
+		"network": "/24",
+	}
+
+	res, err = b.HandleRequest(context.Background(), req)
+	require.Nil(t, err)
+	require.Equal(t, "10.0.2.0/24", res.Data["network"])
+}
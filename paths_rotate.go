@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// keyExpired reports whether the peer key is older than the rotation period.
+func keyExpired(peer *wireguardPeer, rotationPeriod int, now time.Time) bool {
+	return rotationPeriod > 0 && !peer.KeyCreatedAt.IsZero() && now.Sub(peer.KeyCreatedAt) >= time.Duration(rotationPeriod)*time.Second
+}
+
+// rotatePeerKey generates a new private key for the peer.  If the group derives addresses from keys, the peer is given new addresses derived from the new key, avoiding the addresses in used.
+func rotatePeerKey(group *wireguardGroup, peer *wireguardPeer, used ipSet, now time.Time) error {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return fmt.Errorf("error generating private_key: %w", err)
+	}
+
+	peer.PrivateKey = key.String()
+	peer.PublicKey = key.PublicKey().String()
+	peer.KeyCreatedAt = now
+	peer.RotatedAt = now
+
+	if group.IPAMMode == ipamModeKey {
+		peer.IPs, err = allocateIPs(group.Networks, nil, used, group.ReservedRanges, group.ipamKey(peer))
+		if err != nil {
+			return fmt.Errorf("error allocating address: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// rotateExpiredKeys rotates the keys of every peer whose key is older than its rotation period, and rebuilds the groups of the rotated peers.  Peers without a key creation time, such as peers written before rotation was supported, start their rotation period now.  Groups that fail are logged and retried on the next run.
+func (b *wireguardBackend) rotateExpiredKeys(ctx context.Context, s logical.Storage, now time.Time) error {
+	groupNames, err := listGroups(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	for _, groupName := range groupNames {
+		if err := b.rotateExpiredGroupKeys(ctx, s, groupName, now); err != nil {
+			b.Logger().Error("error rotating keys", "group", groupName, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// rotatingPeers returns the names of the peers of a group that have a rotation period, using only the group directory.
+func rotatingPeers(config *wireguardConfig, group *wireguardGroup) []string {
+	names := []string{}
+
+	for _, entry := range group.Peers {
+		if resolveSettings(config.settingsLayer(), group.settingsLayer(), entry.settingsLayer()).int("rotation_period") > 0 {
+			names = append(names, entry.Name)
+		}
+	}
+
+	return names
+}
+
+func (b *wireguardBackend) rotateExpiredGroupKeys(ctx context.Context, s logical.Storage, groupName string, now time.Time) error {
+	config, err := getConfig(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	lock := b.groupLock(groupName)
+
+	// Groups without rotation are skipped under the read lock, so they aren't blocked on every run
+	lock.RLock()
+	group, err := b.getGroup(ctx, s, groupName)
+	if err == nil && group != nil {
+		_, err = applyPendingPeers(ctx, s, group)
+	}
+	lock.RUnlock()
+
+	if err != nil || group == nil || len(rotatingPeers(config, group)) == 0 {
+		return err
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	group, err = b.getGroup(ctx, s, groupName)
+	if err != nil || group == nil {
+		return err
+	}
+
+	if _, err := applyPendingPeers(ctx, s, group); err != nil {
+		return err
+	}
+
+	peerNames := rotatingPeers(config, group)
+
+	rotated := false
+	used := ipSet{}
+	walID := ""
+
+	for _, ips := range groupIPs(group) {
+		for _, ip := range ips {
+			used.add(ip)
+		}
+	}
+
+	for _, peerName := range peerNames {
+		peer, err := getPeer(ctx, s, groupName, peerName)
+		if err != nil {
+			return err
+		}
+
+		// Keys that aren't stored can't be rotated
+		if peer == nil || peer.PrivateKey == "" {
+			continue
+		}
+
+		rotationPeriod := resolveSettings(config.settingsLayer(), group.settingsLayer(), peer.settingsLayer()).int("rotation_period")
+
+		switch {
+		case rotationPeriod > 0 && peer.KeyCreatedAt.IsZero():
+			peer.KeyCreatedAt = now
+		case keyExpired(peer, rotationPeriod, now):
+			if err := rotatePeerKey(group, peer, used, now); err != nil {
+				return fmt.Errorf("error rotating key for peer %s/%s: %w", groupName, peerName, err)
+			}
+
+			// The group is rebuilt after the peers are saved, or by the WAL rollback if that doesn't happen
+			if !rotated {
+				if walID, err = framework.PutWAL(ctx, s, walKindGroupRebuild, &groupWAL{
+					Group: groupName,
+				}); err != nil {
+					return fmt.Errorf("error writing WAL entry: %w", err)
+				}
+			}
+
+			rotated = true
+		default:
+			continue
+		}
+
+		if err := b.putPeer(ctx, s, groupName, peerName, peer); err != nil {
+			return err
+		}
+	}
+
+	if !rotated {
+		return nil
+	}
+
+	res, err := b.updateGroupPeers(ctx, s, group, nil)
+	if err != nil {
+		return err
+	}
+
+	if res != nil && res.IsError() {
+		return res.Error()
+	}
+
+	if err := framework.DeleteWAL(ctx, s, walID); err != nil {
+		return fmt.Errorf("error deleting WAL entry: %w", err)
+	}
+
+	return nil
+}
+
+func (b *wireguardBackend) pathRotateWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	groupname := data.Get("group_name").(string)
+	name := data.Get("name").(string)
+
+	lock := b.groupLock(groupname)
+	lock.Lock()
+	defer lock.Unlock()
+
+	group, err := b.getGroup(ctx, req.Storage, groupname)
+	if err != nil || group == nil {
+		return logical.ErrorResponse("missing group"), err
+	}
+
+	// Addresses are checked against peers that haven't been materialized yet
+	if _, err := applyPendingPeers(ctx, req.Storage, group); err != nil {
+		return nil, err
+	}
+
+	peer, err := getPeer(ctx, req.Storage, groupname, name)
+	if err != nil || peer == nil {
+		return logical.ErrorResponse("missing peer"), err
+	}
+
+	if peer.PrivateKey == "" {
+		return logical.ErrorResponse("peer doesn't have a private_key stored, write a new public_key instead"), nil
+	}
+
+	used := ipSet{}
+
+	for peerName, ips := range groupIPs(group) {
+		if peerName != name {
+			for _, ip := range ips {
+				used.add(ip)
+			}
+		}
+	}
+
+	if err := rotatePeerKey(group, peer, used, time.Now()); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("error rotating key: %s", err)), nil
+	}
+
+	return b.savePeer(ctx, req.Storage, group, name, peer)
+}
+
+// formatTime returns t in RFC 3339 format, or an empty string if t isn't set.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/helper/consts"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotate(t *testing.T) {
+	b, s := getTestBackend(t)
+	res, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/mygroup",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"network":         "10.0.0.0/24",
+			"rotation_period": "24h",
+		},
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	for name, data := range map[string]map[string]interface{}{
+		"peer1": {},
+		"peer2": {
+			"public_key": publicKey,
+		},
+		"peer3": {
+			"rotation_period": "1h",
+		},
+	} {
+		res, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      "groups/mygroup/" + name,
+			Storage:   s,
+			Data:      data,
+		})
+		require.Nil(t, err)
+		require.Nil(t, res)
+	}
+
+	read := func(name string) map[string]interface{} {
+		res, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "groups/mygroup/" + name,
+			Storage:   s,
+		})
+		require.Nil(t, err)
+
+		return res.Data
+	}
+
+	readPrivateKey := func(name string) string {
+		res, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "groups/mygroup/" + name + "/creds",
+			Storage:   s,
+		})
+		require.Nil(t, err)
+
+		return res.Data["private_key"].(string)
+	}
+
+	peer1 := read("peer1")
+	require.NotEqual(t, "", peer1["key_created_at"])
+	require.Equal(t, "", peer1["rotated_at"])
+	require.Equal(t, 86400, peer1["rotation_period"])
+	require.Equal(t, "group", peer1["sources"].(map[string]string)["rotation_period"])
+	require.Equal(t, 3600, read("peer3")["rotation_period"])
+
+	// Nothing has expired
+	require.Nil(t, b.periodicFunc(context.Background(), &logical.Request{
+		Storage: s,
+	}))
+	require.Equal(t, peer1, read("peer1"))
+
+	// peer3 expires first
+	now := time.Now().Add(2 * time.Hour)
+	peer3 := read("peer3")
+	privateKey3 := readPrivateKey("peer3")
+
+	require.Nil(t, b.rotateExpiredKeys(context.Background(), s, now))
+	require.Equal(t, peer1, read("peer1"))
+	require.Equal(t, read("peer2")["public_key"], publicKey)
+
+	rotated := read("peer3")
+	require.NotEqual(t, privateKey3, readPrivateKey("peer3"))
+	require.NotEqual(t, peer3["public_key"], rotated["public_key"])
+	require.Equal(t, peer3["ip"], rotated["ip"])
+	require.Equal(t, formatTime(now), rotated["key_created_at"])
+	require.Equal(t, formatTime(now), rotated["rotated_at"])
+
+	group, err := getGroup(context.Background(), s, "mygroup")
+	require.Nil(t, err)
+
+	for _, peer := range group.Peers {
+		if peer.Name == "peer3" {
+			require.Equal(t, rotated["public_key"], peer.PublicKey)
+		}
+	}
+
+	// Peers without a stored private key are never rotated
+	now = now.Add(48 * time.Hour)
+
+	require.Nil(t, b.rotateExpiredKeys(context.Background(), s, now))
+	require.NotEqual(t, peer1["public_key"], read("peer1")["public_key"])
+	require.Equal(t, read("peer2")["public_key"], publicKey)
+
+	// Peers without a key creation time start their rotation period
+	peer, err := getPeer(context.Background(), s, "mygroup", "peer1")
+	require.Nil(t, err)
+
+	peer.KeyCreatedAt = time.Time{}
+	require.Nil(t, b.putPeer(context.Background(), s, "mygroup", "peer1", peer))
+
+	peer1 = read("peer1")
+	require.Equal(t, "", peer1["key_created_at"])
+
+	// Standbys leave rotation to the primary
+	config := logical.TestBackendConfig()
+	config.Logger = b.Logger()
+	config.StorageView = s
+	config.System = &logical.StaticSystemView{
+		ReplicationStateVal: consts.ReplicationPerformanceStandby,
+	}
+
+	standby, err := newBackend(context.Background(), config)
+	require.Nil(t, err)
+	require.Nil(t, standby.(*wireguardBackend).periodicFunc(context.Background(), &logical.Request{
+		Storage: s,
+	}))
+	require.Equal(t, peer1, read("peer1"))
+
+	require.Nil(t, b.rotateExpiredKeys(context.Background(), s, now))
+
+	created := read("peer1")
+	require.Equal(t, peer1["public_key"], created["public_key"])
+	require.Equal(t, formatTime(now), created["key_created_at"])
+
+	// On demand
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "groups/mygroup/peer1/rotate",
+		Storage:   s,
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+	require.NotEqual(t, created["public_key"], read("peer1")["public_key"])
+	require.NotEqual(t, "", read("peer1")["rotated_at"])
+
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "groups/mygroup/peer2/rotate",
+		Storage:   s,
+	})
+	require.Nil(t, err)
+	require.Equal(t, "peer doesn't have a private_key stored, write a new public_key instead", res.Data["error"])
+
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "groups/mygroup/peer4/rotate",
+		Storage:   s,
+	})
+	require.Nil(t, err)
+	require.Equal(t, "missing peer", res.Data["error"])
+
+	// Groups that fail don't stop the others from rotating
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/failing",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"network":         "10.0.1.0/24",
+			"rotation_period": "24h",
+		},
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/failing/peer1",
+		Storage:   s,
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	peer1 = read("peer1")
+	require.Nil(t, b.rotateExpiredKeys(context.Background(), &failingStorage{
+		Storage: s,
+		key:     "groups/failing/peer1",
+	}, time.Now().Add(48*time.Hour)))
+	require.NotEqual(t, peer1["public_key"], read("peer1")["public_key"])
+}
+
+func TestRotateKeyDerivedAddresses(t *testing.T) {
+	b, s := getTestBackend(t)
+	res, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/mygroup",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"ipam_mode": "key",
+			"network":   "fd00:1::/64",
+		},
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/mygroup/peer1",
+		Storage:   s,
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "groups/mygroup/peer1/rotate",
+		Storage:   s,
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	peer, err := getPeer(context.Background(), s, "mygroup", "peer1")
+	require.Nil(t, err)
+	require.Equal(t, []netip.Addr{
+		deriveIP(netip.MustParsePrefix("fd00:1::/64"), peer.PublicKey, 0),
+	}, peer.IPs)
+
+	group, err := getGroup(context.Background(), s, "mygroup")
+	require.Nil(t, err)
+	require.Equal(t, peer.IPs[0].String()+"/64", group.Peers[0].IP)
+}
+
+// Groups without rotation are skipped without reading their peers
+func TestRotateCost(t *testing.T) {
+	gets := map[int]int64{}
+
+	for _, n := range []int{100, 1000} {
+		backend, s, _ := benchmarkGroup(t, n)
+		resetStorage(s)
+
+		require.Nil(t, backend.rotateExpiredKeys(context.Background(), s, time.Now().Add(48*time.Hour)))
+		require.Equal(t, int64(0), atomic.LoadInt64(&s.puts))
+
+		gets[n] = atomic.LoadInt64(&s.gets)
+
+		// Only the peers with a rotation period are read
+		res, err := backend.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "groups/mygroup/peer00001",
+			Storage:   s,
+			Data: map[string]interface{}{
+				"rotation_period": "1h",
+			},
+		})
+		require.Nil(t, err)
+		require.Nil(t, res)
+
+		peer, err := getPeer(context.Background(), s, "mygroup", "peer00001")
+		require.Nil(t, err)
+
+		resetStorage(s)
+
+		require.Nil(t, backend.rotateExpiredKeys(context.Background(), s, peer.KeyCreatedAt.Add(30*time.Minute)))
+		require.Equal(t, int64(0), atomic.LoadInt64(&s.puts))
+		require.Equal(t, gets[n]+2, atomic.LoadInt64(&s.gets))
+	}
+
+	require.Equal(t, gets[100], gets[1000])
+}
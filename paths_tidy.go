@@ -0,0 +1,539 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+type wireguardTidyConfig struct {
+	Interval           int  `json:"interval"`
+	RemoveExpiredPeers bool `json:"remove_expired_peers"`
+}
+
+type tidyOptions struct {
+	DryRun             bool
+	RemoveExpiredPeers bool
+}
+
+// tidyDuplicate is a public key used by several peers of a group.
+type tidyDuplicate struct {
+	Group     string   `json:"group"`
+	Peers     []string `json:"peers"`
+	PublicKey string   `json:"public_key"`
+}
+
+// tidyReport is what a tidy found, and the repairs it made.  Peers are named group/peer.
+type tidyReport struct {
+	DirectoryMismatches []string        `json:"directory_mismatches"`
+	DryRun              bool            `json:"dry_run"`
+	DuplicatePublicKeys []tidyDuplicate `json:"duplicate_public_keys"`
+	ExpiredPeers        []string        `json:"expired_peers"`
+	FinishedAt          time.Time       `json:"finished_at"`
+	OrphanedEntries     []string        `json:"orphaned_entries"`
+	Repairs             []string        `json:"repairs"`
+	StartedAt           time.Time       `json:"started_at"`
+}
+
+func (r *tidyReport) response() map[string]interface{} {
+	duplicates := make([]map[string]interface{}, len(r.DuplicatePublicKeys))
+
+	for i, duplicate := range r.DuplicatePublicKeys {
+		duplicates[i] = map[string]interface{}{
+			"group":      duplicate.Group,
+			"peers":      duplicate.Peers,
+			"public_key": duplicate.PublicKey,
+		}
+	}
+
+	return map[string]interface{}{
+		"directory_mismatches":  r.DirectoryMismatches,
+		"dry_run":               r.DryRun,
+		"duplicate_public_keys": duplicates,
+		"expired_peers":         r.ExpiredPeers,
+		"finished_at":           formatTime(r.FinishedAt),
+		"orphaned_entries":      r.OrphanedEntries,
+		"repairs":               r.Repairs,
+		"started_at":            formatTime(r.StartedAt),
+	}
+}
+
+func getTidyConfig(ctx context.Context, s logical.Storage) (*wireguardTidyConfig, error) {
+	entry, err := s.Get(ctx, "config/tidy")
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving tidy config: %w", err)
+	}
+
+	var config wireguardTidyConfig
+
+	if entry == nil {
+		return &config, nil
+	}
+
+	if err := entry.DecodeJSON(&config); err != nil {
+		return nil, fmt.Errorf("error decoding tidy config data: %w", err)
+	}
+
+	return &config, nil
+}
+
+// getTidyReport returns the report of the last tidy that wasn't a dry run, or nil if there hasn't been one.  Auto tidy uses its start time for scheduling.
+func getTidyReport(ctx context.Context, s logical.Storage) (*tidyReport, error) {
+	entry, err := s.Get(ctx, "tidy/status")
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving tidy status: %w", err)
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	var report tidyReport
+
+	if err := entry.DecodeJSON(&report); err != nil {
+		return nil, fmt.Errorf("error decoding tidy status data: %w", err)
+	}
+
+	return &report, nil
+}
+
+// tidy finds storage entries that are orphaned or inconsistent, and repairs them unless opts.DryRun is set.
+func (b *wireguardBackend) tidy(ctx context.Context, s logical.Storage, opts tidyOptions, now time.Time) (*tidyReport, error) {
+	b.configLock.RLock()
+	defer b.configLock.RUnlock()
+
+	report := &tidyReport{
+		DirectoryMismatches: []string{},
+		DryRun:              opts.DryRun,
+		DuplicatePublicKeys: []tidyDuplicate{},
+		ExpiredPeers:        []string{},
+		OrphanedEntries:     []string{},
+		Repairs:             []string{},
+		StartedAt:           now,
+	}
+
+	if err := b.tidyOrphans(ctx, s, opts, report); err != nil {
+		return nil, err
+	}
+
+	groupNames, err := listGroups(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range groupNames {
+		if err := b.tidyGroup(ctx, s, name, opts, report, now); err != nil {
+			return nil, fmt.Errorf("error tidying group %s: %w", name, err)
+		}
+	}
+
+	report.FinishedAt = time.Now()
+
+	if !opts.DryRun {
+		if err := b.put(ctx, s, "tidy/status", report); err != nil {
+			return nil, err
+		}
+	}
+
+	return report, nil
+}
+
+// tidyOrphans finds the peers, preshared keys and pending changes of groups that don't exist.
+func (b *wireguardBackend) tidyOrphans(ctx context.Context, s logical.Storage, opts tidyOptions, report *tidyReport) error {
+	groupNames, err := listGroups(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	groups := map[string]bool{}
+	for _, name := range groupNames {
+		groups[name] = true
+	}
+
+	orphans := map[string]bool{}
+
+	for _, prefix := range []string{"creds/", "directory/", "groups/", "pending/", "psk/"} {
+		entries, err := s.List(ctx, prefix)
+		if err != nil {
+			return fmt.Errorf("error listing %s: %w", prefix, err)
+		}
+
+		for _, entry := range entries {
+			name := strings.TrimSuffix(entry, "/")
+			if groups[name] || (prefix == "groups/" && name == entry) {
+				continue
+			}
+
+			orphans[name] = true
+
+			if name == entry {
+				report.OrphanedEntries = append(report.OrphanedEntries, prefix+name)
+
+				continue
+			}
+
+			keys, err := s.List(ctx, prefix+entry)
+			if err != nil {
+				return fmt.Errorf("error listing %s: %w", prefix+entry, err)
+			}
+
+			for _, key := range keys {
+				report.OrphanedEntries = append(report.OrphanedEntries, prefix+entry+key)
+			}
+		}
+	}
+
+	sort.Strings(report.OrphanedEntries)
+
+	if opts.DryRun {
+		return nil
+	}
+
+	names := []string{}
+	for name := range orphans {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := b.rollbackGroupDelete(ctx, s, name); err != nil {
+			return err
+		}
+
+		report.Repairs = append(report.Repairs, "deleted entries of missing group "+name)
+	}
+
+	return nil
+}
+
+// matchesDirectory reports whether the directory entry of a peer is up to date with the peer entry.
+func matchesDirectory(group *wireguardGroup, peer *wireguardPeer, entry wireguardGroupPeer) bool {
+	if len(peer.IPs) != len(group.Networks) {
+		return false
+	}
+
+	expected := groupPeer(group, peer)
+	expected.PresharedKey = entry.PresharedKey
+
+	// No labels and an empty list of labels are the same
+	if strings.Join(expected.Labels, ",") == strings.Join(entry.Labels, ",") {
+		expected.Labels = entry.Labels
+	}
+
+	return reflect.DeepEqual(expected, entry)
+}
+
+// matchesPeerRoutes reports whether the route index has the routes of the directory entry.
+func matchesPeerRoutes(group *wireguardGroup, entry wireguardGroupPeer) bool {
+	routes, ok := group.PeerRoutes[entry.Name]
+	if expected := peerRoutes(entry); len(expected) > 0 {
+		return reflect.DeepEqual(expected, routes)
+	}
+
+	return !ok
+}
+
+// tidyGroup finds directory entries that don't match the peer entries, duplicate public keys and expired peers in a group.
+func (b *wireguardBackend) tidyGroup(ctx context.Context, s logical.Storage, name string, opts tidyOptions, report *tidyReport, now time.Time) error {
+	lock := b.groupLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	group, err := b.getGroup(ctx, s, name)
+	if err != nil || group == nil {
+		return err
+	}
+
+	// The route index only has settled peers
+	state, err := groupState(ctx, s, name)
+	if err != nil {
+		return err
+	}
+
+	if _, err := applyPendingPeers(ctx, s, group); err != nil {
+		return err
+	}
+
+	config, err := getConfig(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	peerNames, err := s.List(ctx, "groups/"+name+"/")
+	if err != nil {
+		return fmt.Errorf("error listing peers: %w", err)
+	}
+
+	peers := map[string]*wireguardPeer{}
+	names := []string{}
+
+	for _, peerName := range peerNames {
+		peer, err := getPeer(ctx, s, name, peerName)
+		if err != nil {
+			return err
+		}
+
+		if peer != nil {
+			peers[peerName] = peer
+			names = append(names, peerName)
+		}
+	}
+
+	// Secrets of peers that were deleted
+	credsNames, err := s.List(ctx, "creds/"+name+"/")
+	if err != nil {
+		return fmt.Errorf("error listing peer creds: %w", err)
+	}
+
+	for _, peerName := range credsNames {
+		if peers[peerName] != nil {
+			continue
+		}
+
+		report.OrphanedEntries = append(report.OrphanedEntries, credsPath(name, peerName))
+
+		if !opts.DryRun {
+			if err := b.delete(ctx, s, credsPath(name, peerName)); err != nil {
+				return err
+			}
+
+			report.Repairs = append(report.Repairs, "deleted creds of missing peer "+name+"/"+peerName)
+		}
+	}
+
+	directory := map[string]wireguardGroupPeer{}
+
+	for _, entry := range group.Peers {
+		directory[entry.Name] = entry
+
+		if peers[entry.Name] == nil {
+			names = append(names, entry.Name)
+		}
+	}
+
+	sort.Strings(names)
+
+	mismatched := false
+
+	for _, peerName := range names {
+		entry, ok := directory[peerName]
+		if peer := peers[peerName]; peer == nil || !ok || !matchesDirectory(group, peer, entry) || state == stateSettled && !matchesPeerRoutes(group, entry) {
+			report.DirectoryMismatches = append(report.DirectoryMismatches, name+"/"+peerName)
+			mismatched = true
+		}
+	}
+
+	// Routes indexed for peers that aren't in the directory
+	for peerName := range group.PeerRoutes {
+		if _, ok := directory[peerName]; !ok && state == stateSettled {
+			mismatched = true
+		}
+	}
+
+	if mismatched && !opts.DryRun {
+		if err := tidyResponse(b.updateGroupPeers(ctx, s, group, nil)); err != nil {
+			return err
+		}
+
+		report.Repairs = append(report.Repairs, "rebuilt group "+name)
+	}
+
+	keys := map[string][]string{}
+	publicKeys := []string{}
+
+	for _, peerName := range names {
+		if peer := peers[peerName]; peer != nil && peer.PublicKey != "" {
+			if len(keys[peer.PublicKey]) == 0 {
+				publicKeys = append(publicKeys, peer.PublicKey)
+			}
+
+			keys[peer.PublicKey] = append(keys[peer.PublicKey], peerName)
+		}
+	}
+
+	for _, publicKey := range publicKeys {
+		if len(keys[publicKey]) < 2 {
+			continue
+		}
+
+		report.DuplicatePublicKeys = append(report.DuplicatePublicKeys, tidyDuplicate{
+			Group:     name,
+			Peers:     keys[publicKey],
+			PublicKey: publicKey,
+		})
+
+		if opts.DryRun {
+			continue
+		}
+
+		// The peer that had the key first keeps it, the others get a new key if it is stored
+		duplicates := append([]string{}, keys[publicKey]...)
+		sort.SliceStable(duplicates, func(i, j int) bool {
+			return peers[duplicates[i]].KeyCreatedAt.Before(peers[duplicates[j]].KeyCreatedAt)
+		})
+
+		for _, peerName := range duplicates[1:] {
+			rotated, err := b.tidyRotate(ctx, s, group, peerName, now)
+			if err != nil {
+				return err
+			}
+
+			if rotated {
+				report.Repairs = append(report.Repairs, "rotated key of peer "+name+"/"+peerName)
+			}
+		}
+	}
+
+	for _, peerName := range names {
+		peer := peers[peerName]
+
+		// Expired keys are rotated, unless the private key isn't stored
+		if peer == nil || peer.PrivateKey != "" || !keyExpired(peer, resolveSettings(config.settingsLayer(), group.settingsLayer(), peer.settingsLayer()).int("rotation_period"), now) {
+			continue
+		}
+
+		report.ExpiredPeers = append(report.ExpiredPeers, name+"/"+peerName)
+
+		if opts.DryRun || !opts.RemoveExpiredPeers {
+			continue
+		}
+
+		if err := tidyResponse(b.savePeer(ctx, s, group, peerName, nil)); err != nil {
+			return err
+		}
+
+		report.Repairs = append(report.Repairs, "deleted expired peer "+name+"/"+peerName)
+	}
+
+	return nil
+}
+
+// tidyRotate gives a peer with a duplicate public key a new key.  Returns false if the peer's private key isn't stored.
+func (b *wireguardBackend) tidyRotate(ctx context.Context, s logical.Storage, group *wireguardGroup, name string, now time.Time) (bool, error) {
+	peer, err := getPeer(ctx, s, group.Name, name)
+	if err != nil || peer == nil || peer.PrivateKey == "" {
+		return false, err
+	}
+
+	used := ipSet{}
+
+	for peerName, ips := range groupIPs(group) {
+		if peerName != name {
+			for _, ip := range ips {
+				used.add(ip)
+			}
+		}
+	}
+
+	if err := rotatePeerKey(group, peer, used, now); err != nil {
+		return false, fmt.Errorf("error rotating key for peer %s: %w", name, err)
+	}
+
+	return true, tidyResponse(b.savePeer(ctx, s, group, name, peer))
+}
+
+// tidyResponse returns the error of a response from a group update.
+func tidyResponse(res *logical.Response, err error) error {
+	if err != nil {
+		return err
+	}
+
+	if res != nil && res.IsError() {
+		return res.Error()
+	}
+
+	return nil
+}
+
+// autoTidy runs a tidy if the tidy interval has passed since the last one.
+func (b *wireguardBackend) autoTidy(ctx context.Context, s logical.Storage, now time.Time) error {
+	config, err := getTidyConfig(ctx, s)
+	if err != nil || config.Interval == 0 {
+		return err
+	}
+
+	last, err := getTidyReport(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	if last != nil && now.Sub(last.StartedAt) < time.Duration(config.Interval)*time.Second {
+		return nil
+	}
+
+	report, err := b.tidy(ctx, s, tidyOptions{
+		RemoveExpiredPeers: config.RemoveExpiredPeers,
+	}, now)
+	if err != nil {
+		return err
+	}
+
+	if len(report.Repairs) > 0 {
+		b.Logger().Info("tidied storage", "repairs", report.Repairs)
+	}
+
+	return nil
+}
+
+func (b *wireguardBackend) pathTidyConfigRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config, err := getTidyConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"interval":             config.Interval,
+			"remove_expired_peers": config.RemoveExpiredPeers,
+		},
+	}, nil
+}
+
+func (b *wireguardBackend) pathTidyConfigWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config, err := getTidyConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if interval, ok := data.GetOk("interval"); ok {
+		config.Interval = interval.(int)
+	}
+
+	if removeExpiredPeers, ok := data.GetOk("remove_expired_peers"); ok {
+		config.RemoveExpiredPeers = removeExpiredPeers.(bool)
+	}
+
+	return nil, b.put(ctx, req.Storage, "config/tidy", config)
+}
+
+func (b *wireguardBackend) pathTidyRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	report, err := getTidyReport(ctx, req.Storage)
+	if err != nil || report == nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: report.response(),
+	}, nil
+}
+
+func (b *wireguardBackend) pathTidyWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	report, err := b.tidy(ctx, req.Storage, tidyOptions{
+		DryRun:             data.Get("dry_run").(bool),
+		RemoveExpiredPeers: data.Get("remove_expired_peers").(bool),
+	}, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: report.response(),
+	}, nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTidy(t *testing.T) {
+	b, s := getTestBackend(t)
+	res, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "groups/mygroup",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"network": "10.0.0.0/24",
+		},
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	for name, data := range map[string]map[string]interface{}{
+		"peer1": {},
+		"peer2": {},
+		"peer3": {},
+		"peer4": {
+			"public_key":      publicKey,
+			"rotation_period": 3600,
+		},
+	} {
+		res, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      "groups/mygroup/" + name,
+			Storage:   s,
+			Data:      data,
+		})
+		require.Nil(t, err)
+		require.Nil(t, res)
+	}
+
+	tidy := func(data map[string]interface{}) map[string]interface{} {
+		res, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "tidy",
+			Storage:   s,
+			Data:      data,
+		})
+		require.Nil(t, err)
+		require.NotEqual(t, "", res.Data["finished_at"])
+		require.NotEqual(t, "", res.Data["started_at"])
+
+		delete(res.Data, "finished_at")
+		delete(res.Data, "started_at")
+
+		return res.Data
+	}
+
+	require.Equal(t, map[string]interface{}{
+		"directory_mismatches":  []string{},
+		"dry_run":               true,
+		"duplicate_public_keys": []map[string]interface{}{},
+		"expired_peers":         []string{},
+		"orphaned_entries":      []string{},
+		"repairs":               []string{},
+	}, tidy(map[string]interface{}{
+		"dry_run": true,
+	}))
+
+	// Entries left behind by a deleted group
+	require.Nil(t, b.put(context.Background(), s, "groups/oldgroup/peer1", &wireguardPeer{
+		Name: "peer1",
+	}))
+	require.Nil(t, b.put(context.Background(), s, "psk/oldgroup", &wireguardGroupPSK{}))
+	require.Nil(t, b.put(context.Background(), s, "creds/mygroup/peer5", &wireguardPeerCreds{
+		PrivateKey: privateKey,
+	}))
+
+	// A peer entry changed without updating the group
+	peer2, err := getPeer(context.Background(), s, "mygroup", "peer2")
+	require.Nil(t, err)
+
+	peer2.Port = 51820
+	require.Nil(t, b.putPeer(context.Background(), s, "mygroup", "peer2", peer2))
+
+	// A peer with the key of another peer
+	peer1, err := getPeer(context.Background(), s, "mygroup", "peer1")
+	require.Nil(t, err)
+
+	peer3, err := getPeer(context.Background(), s, "mygroup", "peer3")
+	require.Nil(t, err)
+
+	peer3.KeyCreatedAt = peer1.KeyCreatedAt.Add(time.Second)
+	peer3.PrivateKey = peer1.PrivateKey
+	peer3.PublicKey = peer1.PublicKey
+	require.Nil(t, b.putPeer(context.Background(), s, "mygroup", "peer3", peer3))
+
+	// A peer whose key expired, and can't be rotated
+	peer4, err := getPeer(context.Background(), s, "mygroup", "peer4")
+	require.Nil(t, err)
+
+	peer4.KeyCreatedAt = time.Now().Add(-2 * time.Hour)
+	require.Nil(t, b.putPeer(context.Background(), s, "mygroup", "peer4", peer4))
+
+	found := map[string]interface{}{
+		"directory_mismatches": []string{
+			"mygroup/peer2",
+			"mygroup/peer3",
+		},
+		"dry_run": true,
+		"duplicate_public_keys": []map[string]interface{}{
+			{
+				"group":      "mygroup",
+				"peers":      []string{"peer1", "peer3"},
+				"public_key": peer1.PublicKey,
+			},
+		},
+		"expired_peers": []string{
+			"mygroup/peer4",
+		},
+		"orphaned_entries": []string{
+			"groups/oldgroup/peer1",
+			"psk/oldgroup",
+			"creds/mygroup/peer5",
+		},
+		"repairs": []string{},
+	}
+
+	// Dry runs don't change anything
+	require.Equal(t, found, tidy(map[string]interface{}{
+		"dry_run": true,
+	}))
+	require.Equal(t, found, tidy(map[string]interface{}{
+		"dry_run": true,
+	}))
+
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "tidy",
+		Storage:   s,
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	found["dry_run"] = false
+	found["repairs"] = []string{
+		"deleted entries of missing group oldgroup",
+		"deleted creds of missing peer mygroup/peer5",
+		"rebuilt group mygroup",
+		"rotated key of peer mygroup/peer3",
+		"deleted expired peer mygroup/peer4",
+	}
+
+	require.Equal(t, found, tidy(map[string]interface{}{
+		"remove_expired_peers": true,
+	}))
+
+	for _, key := range []string{"groups/oldgroup/peer1", "psk/oldgroup", "creds/mygroup/peer5", "groups/mygroup/peer4", "creds/mygroup/peer4"} {
+		entry, err := s.Get(context.Background(), key)
+		require.Nil(t, err)
+		require.Nil(t, entry)
+	}
+
+	group, err := getGroup(context.Background(), s, "mygroup")
+	require.Nil(t, err)
+	require.Len(t, group.Peers, 3)
+	require.Equal(t, 51820, group.Peers[1].Port)
+	require.NotEqual(t, peer1.PublicKey, group.Peers[2].PublicKey)
+
+	peer3, err = getPeer(context.Background(), s, "mygroup", "peer3")
+	require.Nil(t, err)
+	require.Equal(t, group.Peers[2].PublicKey, peer3.PublicKey)
+
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "tidy",
+		Storage:   s,
+	})
+	require.Nil(t, err)
+	require.Equal(t, found["repairs"], res.Data["repairs"])
+
+	require.Equal(t, map[string]interface{}{
+		"directory_mismatches":  []string{},
+		"dry_run":               false,
+		"duplicate_public_keys": []map[string]interface{}{},
+		"expired_peers":         []string{},
+		"orphaned_entries":      []string{},
+		"repairs":               []string{},
+	}, tidy(map[string]interface{}{}))
+
+	// Tidy runs in the background once the interval has passed
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config/tidy",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"interval": "1h",
+		},
+	})
+	require.Nil(t, err)
+	require.Nil(t, res)
+
+	res, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "config/tidy",
+		Storage:   s,
+	})
+	require.Nil(t, err)
+	require.Equal(t, map[string]interface{}{
+		"interval":             3600,
+		"remove_expired_peers": false,
+	}, res.Data)
+
+	require.Nil(t, b.put(context.Background(), s, "psk/oldgroup", &wireguardGroupPSK{}))
+	require.Nil(t, b.autoTidy(context.Background(), s, time.Now()))
+
+	entry, err := s.Get(context.Background(), "psk/oldgroup")
+	require.Nil(t, err)
+	require.NotNil(t, entry)
+
+	require.Nil(t, b.autoTidy(context.Background(), s, time.Now().Add(2*time.Hour)))
+
+	entry, err = s.Get(context.Background(), "psk/oldgroup")
+	require.Nil(t, err)
+	require.Nil(t, entry)
+}
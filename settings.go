@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/hashicorp/vault/sdk/framework"
+)
+
+const (
+	keyPolicyClient   = "client"
+	keyPolicyGenerate = "generate"
+	keyPolicyProvided = "provided"
+)
+
+const (
+	settingsSourceConfig  = "config"
+	settingsSourceDefault = "default"
+	settingsSourceGroup   = "group"
+	settingsSourcePeer    = "peer"
+)
+
+// settingsDefaults are used when a setting isn't set by the engine config, group or peer.
+var settingsDefaults = map[string]interface{}{
+	"dns":                  []string{},
+	"key_policy":           keyPolicyGenerate,
+	"materialize_interval": 0,
+	"max_ttl":              60,
+	"mtu":                  0,
+	"persistent_keepalive": 0,
+	"port":                 0,
+	"preshared_keys":       presharedKeysNone,
+	"private_key_file":     "",
+	"rotation_period":      0,
+	"ttl":                  60,
+}
+
+// settings are the effective values of settings that can be set by the engine config, groups and peers, along with where each value came from.
+type settings struct {
+	Sources map[string]string
+	Values  map[string]interface{}
+}
+
+func isZeroSetting(value interface{}) bool {
+	switch v := value.(type) {
+	case int:
+		return v == 0
+	case string:
+		return v == ""
+	case []string:
+		return len(v) == 0
+	}
+
+	return value == nil
+}
+
+// settingsLayer is the settings set by the engine config, a group or a peer.  Overrides are the keys the layer sets, so zero values can override inherited ones too.  Entries written before overrides were recorded have nil Overrides, and set the keys with non-zero values.
+type settingsLayer struct {
+	Overrides []string
+	Source    string
+	Values    map[string]interface{}
+}
+
+// sets reports whether the layer sets key.
+func (l settingsLayer) sets(key string) bool {
+	if l.Overrides == nil {
+		return !isZeroSetting(l.Values[key])
+	}
+
+	for _, override := range l.Overrides {
+		if override == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// inheritsAny reports whether the layer doesn't set one of keys.
+func (l settingsLayer) inheritsAny(keys ...string) bool {
+	for _, key := range keys {
+		if !l.sets(key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// updateOverrides returns the overrides of the layer after a write.  Settings in the request are set, and settings listed in inherit are unset.  Empty strings also unset settings that don't default to an empty string, like key_policy.
+func (l settingsLayer) updateOverrides(data *framework.FieldData) ([]string, error) {
+	inherit := map[string]bool{}
+
+	if keys, ok := data.GetOk("inherit"); ok {
+		for _, key := range keys.([]string) {
+			if _, ok := l.Values[key]; !ok {
+				return nil, fmt.Errorf("unknown setting in inherit: %s", key)
+			}
+
+			inherit[key] = true
+		}
+	}
+
+	keys := make([]string, 0, len(l.Values))
+	for key := range l.Values {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	overrides := []string{}
+
+	for _, key := range keys {
+		set := l.sets(key)
+
+		if value, ok := data.GetOk(key); ok {
+			defaultValue, _ := settingsDefaults[key].(string)
+			set = value != "" || defaultValue == ""
+		}
+
+		if set && !inherit[key] {
+			overrides = append(overrides, key)
+		}
+	}
+
+	return overrides, nil
+}
+
+// resolveSettings merges the layers in order, with the settings set by later layers overriding earlier ones.
+func resolveSettings(layers ...settingsLayer) *settings {
+	s := &settings{
+		Sources: map[string]string{},
+		Values:  map[string]interface{}{},
+	}
+
+	for key, value := range settingsDefaults {
+		s.Sources[key] = settingsSourceDefault
+		s.Values[key] = value
+	}
+
+	for _, layer := range layers {
+		for key, value := range layer.Values {
+			if _, ok := s.Values[key]; ok && layer.sets(key) {
+				s.Sources[key] = layer.Source
+				s.Values[key] = value
+			}
+		}
+	}
+
+	return s
+}
+
+func (s *settings) int(key string) int {
+	return s.Values[key].(int)
+}
+
+func (s *settings) string(key string) string {
+	return s.Values[key].(string)
+}
+
+func (s *settings) strings(key string) []string {
+	return s.Values[key].([]string)
+}
+
+func validateKeyPolicy(keyPolicy string) error {
+	switch keyPolicy {
+	case "":
+	case keyPolicyClient:
+	case keyPolicyGenerate:
+	case keyPolicyProvided:
+	default:
+		return fmt.Errorf("unknown key_policy: %s", keyPolicy)
+	}
+
+	return nil
+}
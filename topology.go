@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+const (
+	topologyFullMesh = "full_mesh"
+	topologyHubSpoke = "hub_spoke"
+)
+
+const (
+	tunnelFull  = "full"
+	tunnelSplit = "split"
+)
+
+// groupRoutes returns the prefixes routed through a hub: the group networks, any networks kept from before a renumber, and the delegation network.
+func groupRoutes(group *wireguardGroup) []netip.Prefix {
+	routes := append(append([]netip.Prefix{}, group.Networks...), group.PreviousNetworks...)
+
+	if group.DelegationNetwork.IsValid() {
+		routes = append(routes, group.DelegationNetwork)
+	}
+
+	return routes
+}
+
+// topologyPeers returns the peers rendered in the config of the viewer, leaving out the peers it isn't allowed to reach.  In hub_spoke groups, spokes only get the hubs, and the first hub they can reach also gets the routes to the other peers so spokes reach each other through it.  Those are the group routes, or only the addresses of the allowed peers if the group restricts access.  Wireguard only routes a prefix to one peer, so the other hubs keep their own allowed_ips.
+func topologyPeers(group *wireguardGroup, peers []wireguardGroupPeer, viewer wireguardGroupPeer) []wireguardGroupPeer {
+	allowed := []wireguardGroupPeer{}
+
+	for _, peer := range peers {
+		if ok, _ := group.access(viewer, peer); ok {
+			allowed = append(allowed, peer)
+		}
+	}
+
+	if group.Topology != topologyHubSpoke || viewer.Hub {
+		return allowed
+	}
+
+	routes := []string{}
+
+	if group.restrictsAccess() {
+		for _, peer := range allowed {
+			if peer.Name != viewer.Name && !peer.Hub {
+				routes = append(routes, peer.AllowedIPs)
+			}
+		}
+	} else {
+		for _, route := range groupRoutes(group) {
+			routes = append(routes, route.String())
+		}
+	}
+
+	filtered := []wireguardGroupPeer{}
+	routed := false
+
+	for _, peer := range allowed {
+		switch {
+		case peer.Name == viewer.Name:
+		case !peer.Hub:
+			continue
+		case !routed:
+			peer.AllowedIPs = strings.Join(append([]string{peer.AllowedIPs}, routes...), ",")
+			routed = true
+		}
+
+		filtered = append(filtered, peer)
+	}
+
+	return filtered
+}
+
+// relayPeers routes the peers the viewer can't connect to through a relay.  Two peers without a port or endpoints can't reach each other, so the [Peer] section of the other peer is left out and its allowed_ips are added to the first relay both peers can reach.  Peers are rendered as they are if there is no such relay.
+func relayPeers(group *wireguardGroup, peers []wireguardGroupPeer, viewer wireguardGroupPeer) []wireguardGroupPeer {
+	direct := false
+
+	for _, peer := range peers {
+		if peer.Name == viewer.Name {
+			direct = peer.Port != 0 || len(peer.Endpoints) > 0
+		}
+	}
+
+	if direct {
+		return peers
+	}
+
+	relayed := map[string]bool{}
+
+	for _, peer := range peers {
+		if peer.Name == viewer.Name || peer.Endpoint != "" {
+			continue
+		}
+
+		for i, relay := range peers {
+			if ok, _ := group.access(peer, relay); ok && relay.Relay && relay.Endpoint != "" && relay.Name != viewer.Name && relay.Name != peer.Name {
+				peers[i].AllowedIPs += "," + peer.AllowedIPs
+				relayed[peer.Name] = true
+
+				break
+			}
+		}
+	}
+
+	filtered := []wireguardGroupPeer{}
+
+	for _, peer := range peers {
+		if !relayed[peer.Name] {
+			filtered = append(filtered, peer)
+		}
+	}
+
+	return filtered
+}
+
+// forwardingPostUp returns the commands enabling IP forwarding for the address families of the group networks.
+func forwardingPostUp(group *wireguardGroup) []string {
+	commands := []string{}
+
+	for _, network := range group.Networks {
+		if network.Addr().Is4() {
+			commands = append(commands, "sysctl -w net.ipv4.ip_forward=1")
+		} else {
+			commands = append(commands, "sysctl -w net.ipv6.conf.all.forwarding=1")
+		}
+	}
+
+	return commands
+}
+
+// routeDefault adds the default routes to the first exit node rendered for the named peer, so all of its traffic goes through the exit node.  Returns false if there is no exit node.
+func routeDefault(peers []wireguardGroupPeer, name string) bool {
+	for i := range peers {
+		if peers[i].ExitNode && peers[i].Name != name {
+			peers[i].AllowedIPs += ",0.0.0.0/0,::/0"
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// natRules returns the commands masquerading traffic from the group networks that leaves through another interface, and the commands removing them again.  Only traffic leaving through another interface is forwarded, and unless the exit node also forwards for peers as a hub or relay, traffic between peers is dropped, so peers can't reach each other through the exit node when access rules keep them apart.
+func natRules(group *wireguardGroup, forwardsPeers bool) ([]string, []string) {
+	postUp := []string{}
+	postDown := []string{}
+
+	for _, network := range append(append([]netip.Prefix{}, group.Networks...), group.PreviousNetworks...) {
+		iptables := "iptables"
+		if !network.Addr().Is4() {
+			iptables = "ip6tables"
+		}
+
+		rules := []string{}
+
+		if !forwardsPeers {
+			rules = append(rules, "FORWARD -i %i -o %i -j DROP")
+		}
+
+		for _, rule := range append(rules,
+			"FORWARD -i %i ! -o %i -j ACCEPT",
+			"FORWARD -o %i -m state --state RELATED,ESTABLISHED -j ACCEPT",
+			fmt.Sprintf("POSTROUTING -t nat -s %s ! -o %%i -j MASQUERADE", network),
+		) {
+			postUp = append(postUp, iptables+" -A "+rule)
+			postDown = append(postDown, iptables+" -D "+rule)
+		}
+	}
+
+	return postUp, postDown
+}
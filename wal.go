@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// WAL entries are written before operations that change several storage entries, and removed once the operation is done.  If a node crashes in between, the WAL rollback finishes the operation from what was already stored.  Deleted entries can't be restored, so operations are rolled forward rather than undone.
+const (
+	walKindGroupDelete  = "group_delete"
+	walKindGroupRebuild = "group_rebuild"
+	walKindPeer         = "peer"
+	walKindRenumber     = "renumber"
+)
+
+// groupWAL is the WAL entry of an operation on a whole group.
+type groupWAL struct {
+	Group string `json:"group"`
+}
+
+// peerWAL is the WAL entry of a peer write or delete, which is finished by updating the directory entry of the peer from the peer entry.
+type peerWAL struct {
+	Group string `json:"group"`
+	Peer  string `json:"peer"`
+}
+
+// renumberWAL is the WAL entry of a renumber.  It is only finished if the group still has the From networks.
+type renumberWAL struct {
+	From       []netip.Prefix          `json:"from"`
+	Group      string                  `json:"group"`
+	IPs        map[string][]netip.Addr `json:"ips"`
+	Networks   []netip.Prefix          `json:"networks"`
+	Transition bool                    `json:"transition"`
+}
+
+// withWAL runs f with a WAL entry, which is removed once f returns without an error.
+func withWAL(ctx context.Context, s logical.Storage, kind string, data interface{}, f func() (*logical.Response, error)) (*logical.Response, error) {
+	id, err := framework.PutWAL(ctx, s, kind, data)
+	if err != nil {
+		return nil, fmt.Errorf("error writing WAL entry: %w", err)
+	}
+
+	res, err := f()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := framework.DeleteWAL(ctx, s, id); err != nil {
+		return nil, fmt.Errorf("error deleting WAL entry: %w", err)
+	}
+
+	return res, nil
+}
+
+// decodeWAL decodes the data of a WAL entry, which the framework returns as decoded JSON.
+func decodeWAL(data interface{}, v interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+func (b *wireguardBackend) walRollback(ctx context.Context, req *logical.Request, kind string, data interface{}) error {
+	var res *logical.Response
+
+	var err error
+
+	switch kind {
+	case walKindGroupDelete:
+		var entry groupWAL
+		if err := decodeWAL(data, &entry); err != nil {
+			return err
+		}
+
+		err = b.rollbackGroupDelete(ctx, req.Storage, entry.Group)
+	case walKindGroupRebuild:
+		var entry groupWAL
+		if err := decodeWAL(data, &entry); err != nil {
+			return err
+		}
+
+		res, err = b.rollbackGroupRebuild(ctx, req.Storage, entry.Group)
+	case walKindPeer:
+		var entry peerWAL
+		if err := decodeWAL(data, &entry); err != nil {
+			return err
+		}
+
+		res, err = b.rollbackPeer(ctx, req.Storage, entry.Group, entry.Peer)
+	case walKindRenumber:
+		var entry renumberWAL
+		if err := decodeWAL(data, &entry); err != nil {
+			return err
+		}
+
+		res, err = b.rollbackRenumber(ctx, req.Storage, &entry)
+	default:
+		return fmt.Errorf("unknown WAL kind: %s", kind)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// Finishing the operation would keep failing the same way, so the entry is dropped
+	if res != nil && res.IsError() {
+		b.Logger().Warn("couldn't finish operation from WAL entry", "kind", kind, "error", res.Error())
+	}
+
+	return nil
+}
+
+// rollbackGroupDelete removes the remaining peers of a deleted group.  Groups can't be created while peers of a deleted group remain, so a group that exists wasn't deleted.
+func (b *wireguardBackend) rollbackGroupDelete(ctx context.Context, s logical.Storage, name string) error {
+	lock := b.groupLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	group, err := getGroup(ctx, s, name)
+	if err != nil || group != nil {
+		return err
+	}
+
+	return b.deleteGroupEntries(ctx, s, name)
+}
+
+// rollbackGroupRebuild rebuilds a group from its peer entries.
+func (b *wireguardBackend) rollbackGroupRebuild(ctx context.Context, s logical.Storage, name string) (*logical.Response, error) {
+	lock := b.groupLock(name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	group, err := b.getGroup(ctx, s, name)
+	if err != nil || group == nil {
+		return nil, err
+	}
+
+	if _, err := applyPendingPeers(ctx, s, group); err != nil {
+		return nil, err
+	}
+
+	return b.updateGroupPeers(ctx, s, group, nil)
+}
+
+// rollbackPeer updates the directory entry of a peer from the peer entry, removing it if the peer was deleted.
+func (b *wireguardBackend) rollbackPeer(ctx context.Context, s logical.Storage, groupName, name string) (*logical.Response, error) {
+	b.configLock.RLock()
+	defer b.configLock.RUnlock()
+
+	lock := b.groupLock(groupName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	group, err := b.getGroup(ctx, s, groupName)
+	if err != nil || group == nil {
+		return nil, err
+	}
+
+	peer, err := getPeer(ctx, s, groupName, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.updateGroupPeer(ctx, s, group, name, peer)
+}
+
+// rollbackRenumber applies the rest of a renumber, unless the group networks were changed since.
+func (b *wireguardBackend) rollbackRenumber(ctx context.Context, s logical.Storage, entry *renumberWAL) (*logical.Response, error) {
+	b.configLock.Lock()
+	defer b.configLock.Unlock()
+
+	lock := b.groupLock(entry.Group)
+	lock.Lock()
+	defer lock.Unlock()
+
+	group, err := b.getGroup(ctx, s, entry.Group)
+	if err != nil || group == nil {
+		return nil, err
+	}
+
+	if joinPrefixes(group.Networks) != joinPrefixes(entry.From) {
+		return nil, nil
+	}
+
+	if _, err := applyPendingPeers(ctx, s, group); err != nil {
+		return nil, err
+	}
+
+	return b.applyRenumber(ctx, s, group, entry)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWAL(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	createGroup := func() *logical.Response {
+		res, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      "groups/mygroup",
+			Storage:   s,
+			Data: map[string]interface{}{
+				"network": "10.0.0.0/24",
+			},
+		})
+		require.Nil(t, err)
+
+		return res
+	}
+
+	writePeer := func(s logical.Storage, name string) error {
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      "groups/mygroup/" + name,
+			Storage:   s,
+		})
+
+		return err
+	}
+
+	rollback := func() {
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.RollbackOperation,
+			Storage:   s,
+			Data: map[string]interface{}{
+				"immediate": true,
+			},
+		})
+		require.Nil(t, err)
+
+		wals, err := framework.ListWAL(context.Background(), s)
+		require.Nil(t, err)
+		require.Empty(t, wals)
+	}
+
+	getPeers := func() []string {
+		group, err := getGroup(context.Background(), s, "mygroup")
+		require.Nil(t, err)
+
+		names := []string{}
+		for _, peer := range group.Peers {
+			names = append(names, peer.Name)
+		}
+
+		return names
+	}
+
+	require.Nil(t, createGroup())
+
+	for _, name := range []string{"peer1", "peer2"} {
+		require.Nil(t, writePeer(s, name))
+	}
+
+	wals, err := framework.ListWAL(context.Background(), s)
+	require.Nil(t, err)
+	require.Empty(t, wals)
+
+	// Peers that were saved without updating the group are added to it
+	require.NotNil(t, writePeer(&failingStorage{
+		Storage: s,
+		key:     directoryPath("mygroup", directoryBucket("peer3")),
+	}, "peer3"))
+	require.Equal(t, []string{"peer1", "peer2"}, getPeers())
+
+	rollback()
+	require.Equal(t, []string{"peer1", "peer2", "peer3"}, getPeers())
+
+	// Renumbers that were interrupted are finished
+	_, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "renumber/mygroup",
+		Storage: &failingStorage{
+			Storage: s,
+			key:     "groups/mygroup/peer2",
+		},
+		Data: map[string]interface{}{
+			"confirm": true,
+			"network": "10.1.0.0/24",
+		},
+	})
+	require.NotNil(t, err)
+
+	peer, err := getPeer(context.Background(), s, "mygroup", "peer1")
+	require.Nil(t, err)
+	require.Equal(t, "10.1.0.1", joinAddrs(peer.IPs))
+
+	group, err := getGroup(context.Background(), s, "mygroup")
+	require.Nil(t, err)
+	require.Equal(t, "10.0.0.0/24", joinPrefixes(group.Networks))
+
+	rollback()
+
+	peer, err = getPeer(context.Background(), s, "mygroup", "peer2")
+	require.Nil(t, err)
+	require.Equal(t, "10.1.0.2", joinAddrs(peer.IPs))
+
+	group, err = getGroup(context.Background(), s, "mygroup")
+	require.Nil(t, err)
+	require.Equal(t, "10.1.0.0/24", joinPrefixes(group.Networks))
+	require.Equal(t, "10.1.0.2/24", group.Peers[1].IP)
+
+	// Group writes that were interrupted are finished by rebuilding the group
+	_, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "groups/mygroup",
+		Storage: &failingStorage{
+			Storage: s,
+			key:     "groups/mygroup",
+		},
+		Data: map[string]interface{}{
+			"mtu": 1280,
+		},
+	})
+	require.NotNil(t, err)
+
+	wals, err = framework.ListWAL(context.Background(), s)
+	require.Nil(t, err)
+	require.Len(t, wals, 1)
+
+	rollback()
+	require.Equal(t, []string{"peer1", "peer2", "peer3"}, getPeers())
+
+	// Groups that were partially deleted can't be created again until their peers are removed
+	_, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      "groups/mygroup",
+		Storage: &failingStorage{
+			Storage: s,
+			key:     "groups/mygroup/peer2",
+		},
+	})
+	require.NotNil(t, err)
+
+	peerNames, err := s.List(context.Background(), "groups/mygroup/")
+	require.Nil(t, err)
+	require.Equal(t, []string{"peer2", "peer3"}, peerNames)
+
+	res := createGroup()
+	require.True(t, res.IsError())
+	require.Equal(t, "group mygroup is still being deleted", res.Error().Error())
+
+	rollback()
+
+	peerNames, err = s.List(context.Background(), "groups/mygroup/")
+	require.Nil(t, err)
+	require.Empty(t, peerNames)
+	require.Nil(t, createGroup())
+}
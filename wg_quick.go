@@ -5,29 +5,87 @@ import (
 	"text/template"
 )
 
+// wgQuickValues are the values used to render a config.  The interface settings come from the peer entry, while the peers come from the group directory.
 type wgQuickValues struct {
-	Group *wireguardGroup
-	Name  string
+	DNS        []string
+	FullTunnel bool
+	Group      *wireguardGroup
+	MTU        int
+	Name       string
+	Peers      []wireguardGroupPeer
+	// PostDown are commands run after the interface is down, undoing PostUp.
+	PostDown []string
+	// PostUp are commands run after the interface is up, like enabling forwarding on peers other peers are routed through.
+	PostUp     []string
+	PrivateKey string
+	// PrivateKeyFile is where clients that hold their own private key keep it.  If the private key isn't stored or in a file, a placeholder is rendered.
+	PrivateKeyFile string
+	Table          string
 }
 
-var wgQuickTemplate = template.Must(template.New("wgquick").Parse(strings.TrimSpace(`
+// wgQuickPeers returns the group peers with their effective settings, and the endpoints used by a peer in site.
+func wgQuickPeers(group *wireguardGroup, config *wireguardConfig, site string) []wireguardGroupPeer {
+	peers := make([]wireguardGroupPeer, len(group.Peers))
+
+	for i, peer := range group.Peers {
+		s := resolveSettings(config.settingsLayer(), group.settingsLayer(), peer.settingsLayer())
+
+		peer.PersistentKeepalive = s.int("persistent_keepalive")
+		peer.Port = s.int("port")
+		peer.Endpoint = peer.endpoint(site)
+		peers[i] = peer
+	}
+
+	return peers
+}
+
+var wgQuickTemplate = template.Must(template.New("wgquick").Funcs(template.FuncMap{
+	"join": strings.Join,
+}).Parse(strings.TrimSpace(`
 # {{ .Group.Name }}/{{ .Name }}
 
-{{ range .Group.Peers -}}
+{{ range .Peers -}}
 {{ if eq .Name $.Name -}}
 [Interface]
 Address={{ .IP }}
-PrivateKey={{ .PrivateKey }}
+{{- if $.PrivateKey }}
+PrivateKey={{ $.PrivateKey }}
+{{- else if $.PrivateKeyFile }}
+PostUp=wg set %i private-key {{ $.PrivateKeyFile }}
+{{- else }}
+# The private key is held by the client, replace the placeholder with it
+PrivateKey=CLIENT_PRIVATE_KEY
+{{- end }}
+{{- range $.PostUp }}
+PostUp={{ . }}
+{{- end }}
+{{- range $.PostDown }}
+PostDown={{ . }}
+{{- end }}
 {{- if .Port }}
 ListenPort={{ .Port }}
 {{- end }}
+{{- if $.MTU }}
+MTU={{ $.MTU }}
+{{- end }}
+{{- if $.Table }}
+Table={{ $.Table }}
+{{- end }}
+{{- if $.DNS }}
+DNS={{ join $.DNS "," }}
+{{- else if $.FullTunnel }}
+# Set dns for this peer, or DNS queries won't go through the exit node
+{{- end }}
 {{- else }}
 # {{ .Name }}
 [Peer]
 PublicKey={{ .PublicKey }}
+{{- if .PresharedKey }}
+PresharedKey={{ .PresharedKey }}
+{{- end }}
 AllowedIPs={{ .AllowedIPs }}
-{{- if .Port }}
-Endpoint={{ .Hostname }}:{{ .Port }}
+{{- if .Endpoint }}
+Endpoint={{ .Endpoint }}
 {{- else if .PersistentKeepalive }}
 PersistentKeepalive={{ .PersistentKeepalive }}
 {{- end }}